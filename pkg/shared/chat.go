@@ -621,7 +621,7 @@ func (cth *ChatHandle) SendError(Message string) error {
 	if err != nil {
 		switch err.Error() {
 		case "channel_not_found":
-			err = fmt.Errorf("channel_not_found for error channel '%s' on '%s'", cth.ErrorChannel, cth.Identifier())
+			err = fmt.Errorf("channel_not_found for error channel '%s' on '%s'", cth.ErrorChannel.Name, cth.Identifier())
 		}
 	}
 	return err
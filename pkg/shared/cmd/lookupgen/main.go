@@ -0,0 +1,170 @@
+/*
+lookupgen writes a Go enum for a lookup table: a typed int with one constant per
+row, String/MarshalJSON/UnmarshalJSON, and a Sync function which makes the table
+agree with the constants at startup (see shared.SyncEnumIds).
+
+	lookupgen -ini ~/.myprog.ini -db marketdb -table markets -type Market -package markets -out markets_enum.go
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/shared"
+	"go/format"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+type enumValue struct {
+	Ident string
+	Id    int
+	Name  string
+}
+
+var enumTemplate = template.Must(template.New("enum").Parse(`// Code generated by lookupgen from table {{.Table}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/shared"
+)
+
+type {{.Type}} int
+
+const (
+{{- range .Values}}
+	{{.Ident}} {{$.Type}} = {{.Id}} // {{printf "%q" .Name}}
+{{- end}}
+)
+
+var {{.Lower}}Names = map[{{.Type}}]string{
+{{- range .Values}}
+	{{.Ident}}: {{printf "%q" .Name}},
+{{- end}}
+}
+
+var {{.Lower}}ByName = map[string]{{.Type}}{
+{{- range .Values}}
+	{{printf "%q" .Name}}: {{.Ident}},
+{{- end}}
+}
+
+func (v {{.Type}}) String() string {
+	if Name, found := {{.Lower}}Names[v]; found {
+		return Name
+	}
+	return fmt.Sprintf("{{.Type}}(%d)", int(v))
+}
+
+func (v {{.Type}}) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v *{{.Type}}) UnmarshalJSON(Data []byte) error {
+	var Name string
+	if err := json.Unmarshal(Data, &Name); err != nil {
+		return err
+	}
+	Val, found := {{.Lower}}ByName[Name]
+	if !found {
+		return fmt.Errorf("unknown {{.Type}} '%s'", Name)
+	}
+	*v = Val
+	return nil
+}
+
+func {{.Type}}FromName(Name string) ({{.Type}}, bool) {
+	Val, found := {{.Lower}}ByName[Name]
+	return Val, found
+}
+
+// Sync{{.Type}} makes table {{.Table}} hold every constant above under its id.
+func Sync{{.Type}}(Db *shared.DbHandle) error {
+	Want := make(map[int]string)
+	for k, v := range {{.Lower}}Names {
+		Want[int(k)] = v
+	}
+	return shared.SyncEnumIds(Db, {{printf "%q" .Table}}, Want)
+}
+`))
+
+func identFor(Type string, Name string) string {
+	var Buf strings.Builder
+	Buf.WriteString(Type)
+	Upper := true
+	for _, r := range Name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			Upper = true
+			continue
+		}
+		if Upper {
+			r = unicode.ToUpper(r)
+			Upper = false
+		}
+		Buf.WriteRune(r)
+	}
+	return Buf.String()
+}
+
+func main() {
+	IniPath := flag.String("ini", "", "ini file holding the database section")
+	Section := flag.String("db", "", "database section of the ini")
+	Table := flag.String("table", "", "lookup table to read")
+	Type := flag.String("type", "", "Go type name for the enum")
+	Package := flag.String("package", "", "Go package of the generated file")
+	Out := flag.String("out", "", "file to write; stdout if unset")
+	flag.Parse()
+	if *IniPath == "" || *Section == "" || *Table == "" || *Type == "" || *Package == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var Config shared.Configuration
+	Config.LoadAnIni(*IniPath).OrDie("")
+	Db := Config.ConnectDbBySectionOrDie(*Section)
+	LT, err := shared.OpenLookup(*Table, Db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lookupgen: %s\n", err)
+		os.Exit(1)
+	}
+	var Values []enumValue
+	Seen := make(map[string]bool)
+	for _, v := range LT.Items() {
+		Ident := identFor(*Type, v.Name())
+		if Ident == *Type || Seen[Ident] {
+			Ident = fmt.Sprintf("%s%d", identFor(*Type, v.Name()), v.Id())
+		}
+		Seen[Ident] = true
+		Values = append(Values, enumValue{Ident: Ident, Id: v.Id(), Name: v.Name()})
+	}
+	var Buf bytes.Buffer
+	err = enumTemplate.Execute(&Buf, map[string]interface{}{
+		"Table":   *Table,
+		"Package": *Package,
+		"Type":    *Type,
+		"Lower":   strings.ToLower((*Type)[:1]) + (*Type)[1:],
+		"Values":  Values,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lookupgen: %s\n", err)
+		os.Exit(1)
+	}
+	Source, err := format.Source(Buf.Bytes())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lookupgen: generated code doesn't parse: %s\n", err)
+		os.Exit(1)
+	}
+	if *Out == "" {
+		os.Stdout.Write(Source)
+		return
+	}
+	if err = os.WriteFile(*Out, Source, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "lookupgen: %s\n", err)
+		os.Exit(1)
+	}
+}
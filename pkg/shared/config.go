@@ -8,6 +8,7 @@ import (
 	_ "github.com/lib/pq"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,6 +24,7 @@ type Configuration struct {
 	secretMap   sjson.JSON
 	ChatHandles map[string]*ChatHandle
 	DbHandles   map[string]*DbHandle
+	dbhLock     sync.Mutex // Over DbHandles
 	AccessHit   SafeIntCache
 	AccessMiss  SafeIntCache
 	dumpedmap   sjson.JSON
@@ -489,15 +491,14 @@ func (config *Configuration) GetStringOrDie(Path string, DieMsg string, options
 }
 
 func parseLooseTime(stime string) (time.Time, error) {
-	var Time time.Time
-	var err error
-	localLoc, err := time.LoadLocation("Local")
-	if strings.Index(stime, "Z") != -1 {
-		Time, err = time.ParseInLocation("2006-01-02T15:04:05Z", stime, localLoc)
-	} else {
-		Time, err = time.ParseInLocation("2006-01-02T15:04:05-07:00", stime, localLoc)
+	Time, err := localTimeCodec.Parse(stime)
+	if err == nil && Time == nil {
+		err = fmt.Errorf("no time in '%s'", stime)
 	}
-	return Time, err
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *Time, nil
 }
 
 func parseLooseDuration(stime string) (time.Duration, error) {
@@ -600,29 +601,106 @@ func (config *Configuration) configDbhFromSection(Section string) *DbHandle {
 
 	var Caw DbHandle
 	Caw.Section = Section
-	_, err := config.ListedKeysPresent(Section+".dbhost", Section+".dbname", Section+".dbuser", Section+".dbpass")
-	if err != nil {
-		Caw.failed = err
-		return &Caw
+	Caw.config = config
+	var err error
+	if DbType == "fake" {
+		// No server to find; everything below still applies, as it would to the real thing.
+		Caw.fake = true
+		Caw.dbtype = DbTypeMysql
+		if _, Dialect := config.GetString(Section + ".fakedialect"); Dialect == "pgsql" {
+			Caw.dbtype = DbTypePostgres
+		}
+		var found bool
+		if found, Caw.DbName = config.GetString(Section + ".dbname"); !found {
+			Caw.DbName = Section
+		}
+	} else {
+		_, err = config.ListedKeysPresent(Section+".dbhost", Section+".dbname", Section+".dbuser", Section+".dbpass")
+		if err != nil {
+			Caw.failed = err
+			return &Caw
+		}
+		var found bool
+		found, Caw.Host = config.GetString(Section + ".dbhost")
+		if !found {
+			addDbKeyWarning(&Caw, Section+"dbhost", "missing")
+		}
+		found, Caw.DbName = config.GetString(Section + ".dbname")
+		if !found {
+			addDbKeyWarning(&Caw, Section+"dbname", "missing")
+		}
+		found, Caw.Username = config.GetString(Section + ".dbuser")
+		if !found {
+			addDbKeyWarning(&Caw, Section+"dbuser", "missing")
+		}
+		found, Caw.Password = config.GetString(Section + ".dbpass")
+		if !found {
+			addDbKeyWarning(&Caw, Section+"dbpass", "missing")
+		}
 	}
-	var found bool
-	found, Caw.Host = config.GetString(Section + ".dbhost")
-	if !found {
-		addDbKeyWarning(&Caw, Section+"dbhost", "missing")
+	if found, Attempts := config.GetInt(Section + ".retries"); found && Attempts > 1 {
+		Retry := DefaultRetryPolicy
+		Retry.MaxAttempts = Attempts
+		if found, Budget := config.GetString(Section + ".retrybudget"); found {
+			Retry.Budget, err = parseLooseDuration(Budget)
+			if err != nil {
+				addDbKeyWarning(&Caw, Section+".retrybudget", "unparseable duration '%s'", Budget)
+				Retry.Budget = DefaultRetryPolicy.Budget
+			}
+		}
+		Caw.retry = &Retry
 	}
-	found, Caw.DbName = config.GetString(Section + ".dbname")
-	if !found {
-		addDbKeyWarning(&Caw, Section+"dbname", "missing")
+	if found, Timeout := config.GetString(Section + ".querytimeout"); found {
+		Caw.QueryTimeout, err = parseLooseDuration(Timeout)
+		if err != nil {
+			addDbKeyWarning(&Caw, Section+".querytimeout", "unparseable duration '%s'", Timeout)
+		}
 	}
-	found, Caw.Username = config.GetString(Section + ".dbuser")
-	if !found {
-		addDbKeyWarning(&Caw, Section+"dbuser", "missing")
+	if found, Zone := config.GetString(Section + ".timezone"); found {
+		Caw.TimeZone, err = time.LoadLocation(Zone)
+		if err != nil {
+			addDbKeyWarning(&Caw, Section+".timezone", "unknown time zone '%s'", Zone)
+		}
 	}
-	found, Caw.Password = config.GetString(Section + ".dbpass")
-	if !found {
-		addDbKeyWarning(&Caw, Section+"dbpass", "missing")
+	if found, Replicas := config.GetString(Section + ".replicas"); found {
+		for _, v := range strings.Split(Replicas, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				Caw.ReplicaHosts = append(Caw.ReplicaHosts, v)
+			}
+		}
+	}
+	if found, Interval := config.GetString(Section + ".replicacheck"); found {
+		Caw.ReplicaCheck, err = parseLooseDuration(Interval)
+		if err != nil {
+			addDbKeyWarning(&Caw, Section+".replicacheck", "unparseable duration '%s'", Interval)
+		}
+	}
+	_, Caw.ReadOnly = config.GetBool(Section + ".readonly")
+	if found, Size := config.GetInt(Section + ".prepcache"); found {
+		Caw.SetPrepCacheSize(Size)
+	}
+	if found, Threshold := config.GetString(Section + ".slowquery"); found {
+		Caw.SlowQuery, err = parseLooseDuration(Threshold)
+		if err != nil {
+			addDbKeyWarning(&Caw, Section+".slowquery", "unparseable duration '%s'", Threshold)
+		}
+	}
+	for _, v := range []struct {
+		Key  string
+		Dest *time.Duration
+	}{
+		{".monitor", &Caw.Monitor},
+		{".monitoralert", &Caw.MonitorAlert},
+	} {
+		if found, Interval := config.GetString(Section + v.Key); found {
+			*v.Dest, err = parseLooseDuration(Interval)
+			if err != nil {
+				addDbKeyWarning(&Caw, Section+v.Key, "unparseable duration '%s'", Interval)
+			}
+		}
 	}
 	switch DbType {
+	case "fake":
 	case "pgsql":
 		Caw.dbtype = DbTypePostgres
 	case "mysql":
@@ -636,13 +714,16 @@ func (config *Configuration) configDbhFromSection(Section string) *DbHandle {
 }
 
 func (config *Configuration) ConnectDbBySection(SectionName string) *DbHandle {
+	config.dbhLock.Lock()
+	defer config.dbhLock.Unlock()
 	if config.DbHandles == nil {
 		config.DbHandles = make(map[string]*DbHandle)
 	}
 	log.Debugf("Now searching ini file '%s' for database handle '%s'\n", config.IniPath, SectionName)
-	if config.DbHandles[SectionName] != nil {
-		if config.DbHandles[SectionName].Ping() == nil {
-			return config.DbHandles[SectionName]
+	if Existing := config.DbHandles[SectionName]; Existing != nil {
+		// A monitored handle is reconnecting itself; don't stack a second pool on it.
+		if Existing.Health().Monitored || Existing.Ping() == nil {
+			return Existing
 		}
 	}
 	dbh := config.configDbhFromSection(SectionName)
@@ -650,10 +731,33 @@ func (config *Configuration) ConnectDbBySection(SectionName string) *DbHandle {
 	err := dbh.Connect()
 	if err != nil {
 		dbh.failed = fmt.Errorf("Failed to connect to db section '%s': %s\n", dbh.Identifier(), err)
+	} else if dbh.Monitor > 0 {
+		// Only monitor a handle that worked once; otherwise the next call here
+		// should make a fresh one, as for an unmonitored handle.
+		ctx, cancel := dbh.statementContext(nil)
+		err = dbh.PingContext(ctx)
+		cancel()
+		if err != nil {
+			log.Warnf("Not monitoring %s; its first ping failed: %s\n", dbh.Identifier(), err)
+		} else {
+			log.ErrorIff(dbh.StartMonitor(&DbMonitorOptions{Interval: dbh.Monitor, AlertAfter: dbh.MonitorAlert}),
+				"starting monitor")
+		}
 	}
 	return dbh
 }
 
+// dbHandles is a snapshot of DbHandles, for going through without the lock.
+func (config *Configuration) dbHandles() []*DbHandle {
+	config.dbhLock.Lock()
+	defer config.dbhLock.Unlock()
+	var Handles []*DbHandle
+	for _, dbh := range config.DbHandles {
+		Handles = append(Handles, dbh)
+	}
+	return Handles
+}
+
 func (config *Configuration) ConnectDbBySectionOrDie(SectionName string) *DbHandle {
 	var Return *DbHandle
 	Return = config.ConnectDbBySection(SectionName)
@@ -662,6 +766,9 @@ func (config *Configuration) ConnectDbBySectionOrDie(SectionName string) *DbHand
 		os.Exit(1)
 	}
 	err := Return.Ping()
+	if err != nil && Return.rotateOnAuthFailure(err) {
+		err = Return.Ping()
+	}
 	log.FatalIff(err, "DB ping failed for handle '%s'\n", Return.Identifier())
 	return Return
 }
@@ -0,0 +1,435 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"github.com/lib/pq"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Bulk loading. Rows are pulled from a BulkSource one at a time and sent in
+batches: Postgres gets COPY FROM STDIN; MySQL gets LOAD DATA LOCAL INFILE from a
+registered reader, which needs local_infile enabled on the server. Anything
+else, or BulkInsert, uses multi-row INSERTs. Each batch is one transaction.
+
+With BulkAuto, a native load that fails on the first batch (local_infile off, no
+COPY privilege) is retried with INSERTs, and INSERTs are used from then on. Once
+loading is under way, a failed batch goes to OnBatchError; without one, or if it
+returns false, the load stops there. Batches already loaded stay loaded.
+*/
+
+const DefaultBulkBatch = 10000
+
+type BulkMethod int
+
+const (
+	BulkAuto BulkMethod = iota
+	BulkNative
+	BulkInsert
+)
+
+// BulkSource yields one row per call to Next, with values in column order, and
+// io.EOF once it runs out.
+type BulkSource interface {
+	Next() ([]interface{}, error)
+}
+
+// BulkSourceFunc adapts an iterator function to a BulkSource.
+type BulkSourceFunc func() ([]interface{}, error)
+
+func (f BulkSourceFunc) Next() ([]interface{}, error) {
+	return f()
+}
+
+type BulkProgress struct {
+	Table   string
+	Rows    int64 // Rows loaded so far
+	Batches int   // Batches loaded so far
+	Failed  int   // Batches which failed and were skipped
+	Elapsed time.Duration
+}
+
+type BulkOptions struct {
+	Columns      []string // Column order of the source's rows; required unless the source supplies it
+	BatchSize    int      // Rows per batch; DefaultBulkBatch if zero
+	Method       BulkMethod
+	Progress     func(BulkProgress)
+	OnBatchError func(Batch int, FirstRow int64, err error) bool // Return true to skip the batch and go on
+}
+
+type BulkBatchError struct {
+	Table    string
+	Batch    int
+	FirstRow int64
+	Rows     int
+	Err      error
+}
+
+func (e *BulkBatchError) Error() string {
+	return fmt.Sprintf("bulk load into '%s': batch %d (rows %d-%d) failed: %s",
+		e.Table, e.Batch, e.FirstRow, e.FirstRow+int64(e.Rows)-1, e.Err)
+}
+
+func (e *BulkBatchError) Unwrap() error {
+	return e.Err
+}
+
+type sliceBulkSource struct {
+	rows [][]interface{}
+	pos  int
+}
+
+func (s *sliceBulkSource) Next() ([]interface{}, error) {
+	if s.pos >= len(s.rows) {
+		return nil, io.EOF
+	}
+	s.pos++
+	return s.rows[s.pos-1], nil
+}
+
+func SliceBulkSource(Rows [][]interface{}) BulkSource {
+	return &sliceBulkSource{rows: Rows}
+}
+
+// JsonBulkSource reads Columns out of each row; missing keys become NULL.
+func JsonBulkSource(Rows sjson.JSONarray, Columns []string) BulkSource {
+	var Pos int
+	return BulkSourceFunc(func() ([]interface{}, error) {
+		if Pos >= len(Rows) {
+			return nil, io.EOF
+		}
+		Row := make([]interface{}, len(Columns))
+		for k, c := range Columns {
+			Row[k] = jsonColumnValue(Rows[Pos][c])
+		}
+		Pos++
+		return Row, nil
+	})
+}
+
+type CsvBulkSource struct {
+	Reader  *csv.Reader
+	Null    string // Fields equal to this load as NULL, if set
+	columns []string
+}
+
+// NewCsvBulkSource reads CSV from r. With Header set, the first record names
+// the columns, and BulkLoad uses them if BulkOptions.Columns is empty.
+func NewCsvBulkSource(r io.Reader, Header bool) (*CsvBulkSource, error) {
+	Src := &CsvBulkSource{Reader: csv.NewReader(r)}
+	if Header {
+		Cols, err := Src.Reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV header: %w", err)
+		}
+		Src.columns = Cols
+	}
+	return Src, nil
+}
+
+func (s *CsvBulkSource) Columns() []string {
+	return s.columns
+}
+
+func (s *CsvBulkSource) Next() ([]interface{}, error) {
+	Record, err := s.Reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	Row := make([]interface{}, len(Record))
+	for k, v := range Record {
+		if s.Null != "" && v == s.Null {
+			continue
+		}
+		Row[k] = v
+	}
+	return Row, nil
+}
+
+// mysqlInfileValue renders v for LOAD DATA's default format: tab-separated,
+// newline-terminated, backslash escapes, \N for NULL. DATETIME has no zone, so
+// times are written in Loc, the zone the connection reads them in.
+func mysqlInfileValue(v interface{}, Loc *time.Location) string {
+	var Str string
+	switch Val := v.(type) {
+	case nil:
+		return `\N`
+	case string:
+		Str = Val
+	case []byte:
+		Str = string(Val)
+	case bool:
+		if Val {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return Val.In(Loc).Format("2006-01-02 15:04:05.999999")
+	case int64:
+		return strconv.FormatInt(Val, 10)
+	case float64:
+		return strconv.FormatFloat(Val, 'g', -1, 64)
+	default:
+		Str = fmt.Sprintf("%v", jsonColumnValue(v))
+	}
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`).Replace(Str)
+}
+
+var bulkReaderSeq uint64
+
+// bulkLoadMysql runs LOAD DATA in a transaction. LOCAL makes the server turn
+// bad rows into warnings (and duplicates into skips) rather than errors, so a
+// batch which doesn't load every row cleanly is rolled back and reported.
+func (dbh *DbHandle) bulkLoadMysql(ctx context.Context, Table string, Cols []string, Rows [][]interface{}) (int64, error) {
+	var Buf bytes.Buffer
+	Loc := dbh.TimeCodec().location()
+	for _, Row := range Rows {
+		for k, v := range Row {
+			if k > 0 {
+				Buf.WriteByte('\t')
+			}
+			Buf.WriteString(mysqlInfileValue(v, Loc))
+		}
+		Buf.WriteByte('\n')
+	}
+	Name := fmt.Sprintf("bulk_%d", atomic.AddUint64(&bulkReaderSeq, 1))
+	mysql.RegisterReaderHandler(Name, func() io.Reader { return &Buf })
+	defer mysql.DeregisterReaderHandler(Name)
+	var Quoted []string
+	for _, v := range Cols {
+		Quoted = append(Quoted, quoteIdentFor(DbTypeMysql, v))
+	}
+	Tx, err := dbh.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer Tx.Rollback()
+	Res, err := Tx.ExecContext(ctx, fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' INTO TABLE %s (%s)",
+		Name, quoteIdentFor(DbTypeMysql, Table), strings.Join(Quoted, ",")))
+	if err != nil {
+		return 0, err
+	}
+	Affected, err := Res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	Warnings, err := mysqlWarnings(ctx, Tx)
+	if err != nil {
+		return 0, err
+	}
+	if Affected != int64(len(Rows)) || len(Warnings) > 0 {
+		return 0, fmt.Errorf("LOAD DATA loaded %d of %d rows with %d warnings: %s",
+			Affected, len(Rows), len(Warnings), strings.Join(Warnings, "; "))
+	}
+	if err = Tx.Commit(); err != nil {
+		return 0, err
+	}
+	return Affected, nil
+}
+
+// mysqlWarnings returns the warnings from the last statement on Tx.
+func mysqlWarnings(ctx context.Context, Tx *sql.Tx) ([]string, error) {
+	Rows, err := Tx.QueryContext(ctx, "SHOW WARNINGS")
+	if err != nil {
+		return nil, err
+	}
+	defer Rows.Close()
+	var Warnings []string
+	for Rows.Next() {
+		var Level, Message string
+		var Code int
+		if err = Rows.Scan(&Level, &Code, &Message); err != nil {
+			return nil, err
+		}
+		Warnings = append(Warnings, fmt.Sprintf("%s %d: %s", Level, Code, Message))
+	}
+	return Warnings, Rows.Err()
+}
+
+func (dbh *DbHandle) bulkLoadPg(ctx context.Context, Table string, Cols []string, Rows [][]interface{}) (int64, error) {
+	Tx, err := dbh.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer Tx.Rollback()
+	Copy := pq.CopyIn(Table, Cols...)
+	if Dot := strings.Index(Table, "."); Dot > 0 {
+		Copy = pq.CopyInSchema(Table[:Dot], Table[Dot+1:], Cols...)
+	}
+	Stmt, err := Tx.PrepareContext(ctx, Copy)
+	if err != nil {
+		return 0, err
+	}
+	Vals := make([]interface{}, len(Cols))
+	for _, Row := range Rows {
+		for k, v := range Row {
+			Vals[k] = jsonColumnValue(v)
+		}
+		if _, err = Stmt.ExecContext(ctx, Vals...); err != nil {
+			Stmt.Close()
+			return 0, err
+		}
+	}
+	if _, err = Stmt.ExecContext(ctx); err != nil {
+		Stmt.Close()
+		return 0, err
+	}
+	if err = Stmt.Close(); err != nil {
+		return 0, err
+	}
+	if err = Tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(Rows)), nil
+}
+
+// bulkLoadInsert sends the batch as multi-row INSERTs in one transaction, so
+// like COPY and LOAD DATA it lands whole or not at all.
+func (dbh *DbHandle) bulkLoadInsert(ctx context.Context, Table string, Cols []string, Rows [][]interface{}) (int64, error) {
+	Tx, err := dbh.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer Tx.Rollback()
+	ib := &insertBuilder{Db: dbh.DB, Type: dbh.dbtype, Table: Table}
+	Batch := DefaultInsertBatch
+	if Batch*len(Cols) > maxBindParams {
+		Batch = maxBindParams / len(Cols)
+	}
+	var Total int64
+	for Start := 0; Start < len(Rows); Start += Batch {
+		End := Start + Batch
+		if End > len(Rows) {
+			End = len(Rows)
+		}
+		var Json []sjson.JSON
+		for _, Row := range Rows[Start:End] {
+			Caw := sjson.NewJson()
+			for k, c := range Cols {
+				Caw[c] = Row[k]
+			}
+			Json = append(Json, Caw)
+		}
+		Query, Args := ib.statement(Cols, Json)
+		Res, err := Tx.ExecContext(ctx, Query, Args...)
+		if err != nil {
+			return 0, err
+		}
+		Affected, _ := Res.RowsAffected()
+		Total += Affected
+	}
+	if err = Tx.Commit(); err != nil {
+		return 0, err
+	}
+	return Total, nil
+}
+
+// BulkLoad streams every row of Source into Table, returning the number of rows
+// loaded. The error is a *BulkBatchError if a batch failed and wasn't skipped.
+func (dbh *DbHandle) BulkLoad(ctx context.Context, Table string, Source BulkSource, Opts *BulkOptions) (int64, error) {
+	var Options BulkOptions
+	if Opts != nil {
+		Options = *Opts
+	}
+	if ctx == nil {
+		ctx = dbh.baseContext()
+	}
+	Cols := Options.Columns
+	if Cols == nil {
+		if Named, ok := Source.(interface{ Columns() []string }); ok {
+			Cols = Named.Columns()
+		}
+	}
+	if len(Cols) == 0 {
+		return 0, fmt.Errorf("bulk load into '%s' needs a column list", Table)
+	}
+	BatchSize := Options.BatchSize
+	if BatchSize <= 0 {
+		BatchSize = DefaultBulkBatch
+	}
+	Load := dbh.bulkLoadInsert
+	if Options.Method != BulkInsert {
+		switch dbh.dbtype {
+		case DbTypePostgres:
+			Load = dbh.bulkLoadPg
+		case DbTypeMysql:
+			Load = dbh.bulkLoadMysql
+		default:
+			if Options.Method == BulkNative {
+				return 0, fmt.Errorf("%s has no native bulk load", dbh.Identifier())
+			}
+		}
+	}
+	Progress := BulkProgress{Table: Table}
+	Started := time.Now()
+	var RowsRead int64
+	var Batch int
+	for Done := false; !Done; {
+		var Rows [][]interface{}
+		for len(Rows) < BatchSize {
+			Row, err := Source.Next()
+			if err == io.EOF {
+				Done = true
+				break
+			}
+			if err != nil {
+				return Progress.Rows, fmt.Errorf("bulk load into '%s': reading row %d: %w", Table, RowsRead+int64(len(Rows)), err)
+			}
+			if len(Row) != len(Cols) {
+				return Progress.Rows, fmt.Errorf("bulk load into '%s': row %d has %d values for %d columns",
+					Table, RowsRead+int64(len(Rows)), len(Row), len(Cols))
+			}
+			Rows = append(Rows, Row)
+		}
+		if len(Rows) == 0 {
+			break
+		}
+		FirstRow := RowsRead
+		RowsRead += int64(len(Rows))
+		Batch++
+		Loaded, err := Load(ctx, Table, Cols, Rows)
+		if err != nil && Batch == 1 && Options.Method == BulkAuto && ctx.Err() == nil &&
+			(dbh.dbtype == DbTypePostgres || dbh.dbtype == DbTypeMysql) {
+			log.Warnf("Native bulk load into '%s' on %s failed, falling back to INSERT: %s\n", Table, dbh.Identifier(), err)
+			Load = dbh.bulkLoadInsert
+			Loaded, err = Load(ctx, Table, Cols, Rows)
+		}
+		if err != nil {
+			BatchErr := &BulkBatchError{Table: Table, Batch: Batch, FirstRow: FirstRow, Rows: len(Rows), Err: dbErrorOrNil(err)}
+			if Options.OnBatchError == nil || !Options.OnBatchError(Batch, FirstRow, BatchErr) {
+				return Progress.Rows, BatchErr
+			}
+			log.Warnf("%s; skipping it.\n", BatchErr)
+			Progress.Failed++
+		} else {
+			Progress.Rows += Loaded
+			Progress.Batches++
+		}
+		if Options.Progress != nil {
+			Progress.Elapsed = time.Since(Started)
+			Options.Progress(Progress)
+		}
+	}
+	log.Debugf("Bulk loaded %d rows into '%s' on %s in %s (%d batches, %d failed)\n",
+		Progress.Rows, Table, dbh.Identifier(), time.Since(Started), Progress.Batches, Progress.Failed)
+	return Progress.Rows, nil
+}
+
+// BulkLoadCsv loads CSV from r, taking column names from its header row.
+func (dbh *DbHandle) BulkLoadCsv(ctx context.Context, Table string, r io.Reader, Opts *BulkOptions) (int64, error) {
+	Src, err := NewCsvBulkSource(r, true)
+	if err != nil {
+		return 0, err
+	}
+	return dbh.BulkLoad(ctx, Table, Src, Opts)
+}
@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMysqlInfileValue(t *testing.T) {
+	Loc := time.FixedZone("EST", -5*3600)
+	At := time.Date(2024, 3, 1, 17, 30, 0, 0, time.UTC)
+	if Got := mysqlInfileValue(At, Loc); Got != "2024-03-01 12:30:00" {
+		t.Errorf("time in EST is '%s'", Got)
+	}
+	if Got := mysqlInfileValue("a\tb\\", Loc); Got != `a\tb\\` {
+		t.Errorf("escaped string is '%s'", Got)
+	}
+	if Got := mysqlInfileValue(nil, Loc); Got != `\N` {
+		t.Errorf("NULL is '%s'", Got)
+	}
+}
+
+func TestBulkLoadMysqlWarnings(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypeMysql)
+	Fake.On(`^LOAD DATA`).Affected(2).Once()
+	Fake.On(`^LOAD DATA`).Affected(1)
+	Fake.On(`^SHOW WARNINGS`).Return([]string{"Level", "Code", "Message"}).Once()
+	Fake.On(`^SHOW WARNINGS`).Return([]string{"Level", "Code", "Message"},
+		[]interface{}{"Warning", int64(1062), "Duplicate entry 'eth-usd' for key 'name'"}).Once()
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	Rows := [][]interface{}{{"btc-usd"}, {"eth-usd"}}
+	Source := func() BulkSource {
+		var i int
+		return BulkSourceFunc(func() ([]interface{}, error) {
+			if i == len(Rows) {
+				return nil, io.EOF
+			}
+			i++
+			return Rows[i-1], nil
+		})
+	}
+	Opts := &BulkOptions{Columns: []string{"name"}, Method: BulkNative}
+	if Loaded, err := dbh.BulkLoad(nil, "markets", Source(), Opts); err != nil || Loaded != 2 {
+		t.Errorf("clean load gave %d, %v", Loaded, err)
+	}
+	Loaded, err := dbh.BulkLoad(nil, "markets", Source(), Opts)
+	var BatchErr *BulkBatchError
+	if !errors.As(err, &BatchErr) || Loaded != 0 {
+		t.Errorf("a load with a skipped row gave %d, %v", Loaded, err)
+	}
+}
@@ -0,0 +1,85 @@
+package shared
+
+import (
+	"context"
+	"github.com/grammaton76/g76golib/pkg/sentry"
+	"time"
+)
+
+/*
+Every statement run through a DbHandle gets a context. Calls without one use the
+handle's base context, which CancelInFlight() cancels; CancelOnTrip hooks that
+to a sentry's TripwireFunc, and calling it on shutdown abandons stuck queries.
+If the handle has a QueryTimeout and the context has no deadline of its own,
+the timeout is applied.
+*/
+
+func (dbh *DbHandle) baseContext() context.Context {
+	dbh.ctxLock.Lock()
+	defer dbh.ctxLock.Unlock()
+	if dbh.baseCtx == nil {
+		dbh.baseCtx, dbh.baseCancel = context.WithCancel(context.Background())
+	}
+	return dbh.baseCtx
+}
+
+// CancelInFlight cancels every statement currently running on the handle
+// without a caller-supplied context. Later statements run normally.
+func (dbh *DbHandle) CancelInFlight() {
+	dbh.ctxLock.Lock()
+	defer dbh.ctxLock.Unlock()
+	if dbh.baseCancel != nil {
+		log.Warnf("Cancelling in-flight statements on '%s'\n", dbh.Identifier())
+		dbh.baseCancel()
+	}
+	dbh.baseCtx, dbh.baseCancel = context.WithCancel(context.Background())
+}
+
+func (dbh *DbHandle) SetQueryTimeout(Timeout time.Duration) *DbHandle {
+	dbh.QueryTimeout = Timeout
+	return dbh
+}
+
+func (dbh *DbHandle) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = dbh.baseContext()
+	}
+	if dbh.QueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, found := ctx.Deadline(); found {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, dbh.QueryTimeout)
+}
+
+// For results that outlive the call (rows, a Row awaiting Scan), we can't cancel
+// on return; let the timeout release the context instead.
+func (dbh *DbHandle) cancelAfterTimeout(cancel context.CancelFunc) {
+	if dbh.QueryTimeout > 0 {
+		time.AfterFunc(dbh.QueryTimeout, cancel)
+	}
+}
+
+// CancelOnTrip makes s cancel the handle's in-flight statements when it trips,
+// after whatever TripwireFunc it already had.
+func (dbh *DbHandle) CancelOnTrip(s *sentry.Sentry) *DbHandle {
+	s.TripwireFunc = dbh.cancelOnTrip(s.TripwireFunc)
+	return dbh
+}
+
+// CancelOnTeamTrip does the same for every sentry of st.
+func (dbh *DbHandle) CancelOnTeamTrip(st *sentry.SentryTeam) *DbHandle {
+	st.TripwireFunc = dbh.cancelOnTrip(st.TripwireFunc)
+	return dbh
+}
+
+func (dbh *DbHandle) cancelOnTrip(Prev func(*sentry.Sentry)) func(*sentry.Sentry) {
+	return func(Tripped *sentry.Sentry) {
+		if Prev != nil {
+			Prev(Tripped)
+		}
+		log.Warnf("Sentry '%s' tripped.\n", Tripped.Identifier())
+		dbh.CancelInFlight()
+	}
+}
@@ -0,0 +1,307 @@
+package shared
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"regexp"
+)
+
+/*
+Backend-neutral classification of database errors. Errors coming back from our
+Stmt wrappers are *DbError, so callers can test the class without caring about
+the driver:
+
+	if errors.Is(err, shared.ErrDuplicateKey) { ... }
+
+and still get at the driver's own error with errors.As(err, &pqErr).
+*/
+
+type DbErrorKind int
+
+const (
+	DbErrUnknown              DbErrorKind = 0
+	DbErrDuplicateKey         DbErrorKind = 1
+	DbErrForeignKeyViolation  DbErrorKind = 2
+	DbErrNotNullViolation     DbErrorKind = 3
+	DbErrCheckViolation       DbErrorKind = 4
+	DbErrDeadlock             DbErrorKind = 5
+	DbErrSerializationFailure DbErrorKind = 6
+	DbErrConnectionLost       DbErrorKind = 7
+	DbErrTimeout              DbErrorKind = 8
+	DbErrSyntax               DbErrorKind = 9
+	DbErrPermissionDenied     DbErrorKind = 10
+	DbErrTooManyConnections   DbErrorKind = 11
+)
+
+var dbErrorKindToString = map[DbErrorKind]string{
+	DbErrUnknown:              "unknown",
+	DbErrDuplicateKey:         "duplicate_key",
+	DbErrForeignKeyViolation:  "foreign_key_violation",
+	DbErrNotNullViolation:     "not_null_violation",
+	DbErrCheckViolation:       "check_violation",
+	DbErrDeadlock:             "deadlock",
+	DbErrSerializationFailure: "serialization_failure",
+	DbErrConnectionLost:       "connection_lost",
+	DbErrTimeout:              "timeout",
+	DbErrSyntax:               "syntax_error",
+	DbErrPermissionDenied:     "permission_denied",
+	DbErrTooManyConnections:   "too_many_connections",
+}
+
+func (k DbErrorKind) String() string {
+	return dbErrorKindToString[k]
+}
+
+// A bare kind is itself an error, which is what makes the sentinels below work
+// with errors.Is.
+func (k DbErrorKind) Error() string {
+	return "database error: " + k.String()
+}
+
+var (
+	ErrDuplicateKey         error = DbErrDuplicateKey
+	ErrForeignKeyViolation  error = DbErrForeignKeyViolation
+	ErrNotNullViolation     error = DbErrNotNullViolation
+	ErrCheckViolation       error = DbErrCheckViolation
+	ErrDeadlock             error = DbErrDeadlock
+	ErrSerializationFailure error = DbErrSerializationFailure
+	ErrConnectionLost       error = DbErrConnectionLost
+	ErrTimeout              error = DbErrTimeout
+	ErrSyntax               error = DbErrSyntax
+	ErrPermissionDenied     error = DbErrPermissionDenied
+	ErrTooManyConnections   error = DbErrTooManyConnections
+)
+
+type DbError struct {
+	Kind       DbErrorKind
+	Code       string // Driver-specific code: mysql errno or SQLSTATE
+	Constraint string
+	Table      string
+	Column     string
+	Err        error
+}
+
+func (e *DbError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DbError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DbError) Is(target error) bool {
+	if Kind, ok := target.(DbErrorKind); ok {
+		return Kind != DbErrUnknown && Kind == e.Kind
+	}
+	return false
+}
+
+var (
+	mysqlDupKeyRe    = regexp.MustCompile("for key '([^']+)'")
+	mysqlFkRe        = regexp.MustCompile("foreign key constraint fails \\(`[^`]*`\\.`([^`]+)`, CONSTRAINT `([^`]+)`")
+	mysqlColumnRe    = regexp.MustCompile("(?i)field '([^']+)'|column '([^']+)'")
+	mysqlCheckRe     = regexp.MustCompile("(?i)check constraint '([^']+)'")
+	mysqlDeniedRe    = regexp.MustCompile("for table '([^']+)'")
+	dbErrorKindMysql = map[uint16]DbErrorKind{
+		mysqlerr.ER_DUP_ENTRY:                    DbErrDuplicateKey,
+		mysqlerr.ER_DUP_ENTRY_WITH_KEY_NAME:      DbErrDuplicateKey,
+		mysqlerr.ER_NO_REFERENCED_ROW:            DbErrForeignKeyViolation,
+		mysqlerr.ER_ROW_IS_REFERENCED:            DbErrForeignKeyViolation,
+		mysqlerr.ER_NO_REFERENCED_ROW_2:          DbErrForeignKeyViolation,
+		mysqlerr.ER_ROW_IS_REFERENCED_2:          DbErrForeignKeyViolation,
+		mysqlerr.ER_BAD_NULL_ERROR:               DbErrNotNullViolation,
+		mysqlerr.ER_NO_DEFAULT_FOR_FIELD:         DbErrNotNullViolation,
+		mysqlerr.ER_CHECK_CONSTRAINT_VIOLATED:    DbErrCheckViolation,
+		mysqlerr.ER_LOCK_DEADLOCK:                DbErrDeadlock,
+		mysqlerr.ER_LOCK_WAIT_TIMEOUT:            DbErrTimeout,
+		mysqlerr.ER_QUERY_TIMEOUT:                DbErrTimeout,
+		mysqlerr.ER_QUERY_INTERRUPTED:            DbErrTimeout,
+		mysqlerr.ER_PARSE_ERROR:                  DbErrSyntax,
+		mysqlerr.ER_ACCESS_DENIED_ERROR:          DbErrPermissionDenied,
+		mysqlerr.ER_DBACCESS_DENIED_ERROR:        DbErrPermissionDenied,
+		mysqlerr.ER_TABLEACCESS_DENIED_ERROR:     DbErrPermissionDenied,
+		mysqlerr.ER_COLUMNACCESS_DENIED_ERROR:    DbErrPermissionDenied,
+		mysqlerr.ER_SPECIFIC_ACCESS_DENIED_ERROR: DbErrPermissionDenied,
+		mysqlerr.ER_CON_COUNT_ERROR:              DbErrTooManyConnections,
+		mysqlerr.ER_TOO_MANY_USER_CONNECTIONS:    DbErrTooManyConnections,
+	}
+	dbErrorKindPg = map[string]DbErrorKind{
+		"unique_violation":                    DbErrDuplicateKey,
+		"foreign_key_violation":               DbErrForeignKeyViolation,
+		"not_null_violation":                  DbErrNotNullViolation,
+		"check_violation":                     DbErrCheckViolation,
+		"deadlock_detected":                   DbErrDeadlock,
+		"serialization_failure":               DbErrSerializationFailure,
+		"query_canceled":                      DbErrTimeout,
+		"lock_not_available":                  DbErrTimeout,
+		"syntax_error":                        DbErrSyntax,
+		"insufficient_privilege":              DbErrPermissionDenied,
+		"invalid_password":                    DbErrPermissionDenied,
+		"invalid_authorization_specification": DbErrPermissionDenied,
+		"too_many_connections":                DbErrTooManyConnections,
+		"admin_shutdown":                      DbErrConnectionLost,
+		"crash_shutdown":                      DbErrConnectionLost,
+		"cannot_connect_now":                  DbErrConnectionLost,
+	}
+)
+
+func isConnectionLoss(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func firstSubmatch(re *regexp.Regexp, s string) string {
+	Match := re.FindStringSubmatch(s)
+	if Match == nil {
+		return ""
+	}
+	for _, v := range Match[1:] {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func classifyMysqlError(e *DbError, myErr *mysql.MySQLError) {
+	e.Code = fmt.Sprintf("%d", myErr.Number)
+	e.Kind = dbErrorKindMysql[myErr.Number]
+	Msg := myErr.Message
+	switch e.Kind {
+	case DbErrDuplicateKey:
+		e.Constraint = firstSubmatch(mysqlDupKeyRe, Msg)
+	case DbErrForeignKeyViolation:
+		if Match := mysqlFkRe.FindStringSubmatch(Msg); Match != nil {
+			e.Table, e.Constraint = Match[1], Match[2]
+		}
+	case DbErrNotNullViolation:
+		e.Column = firstSubmatch(mysqlColumnRe, Msg)
+	case DbErrCheckViolation:
+		e.Constraint = firstSubmatch(mysqlCheckRe, Msg)
+	case DbErrPermissionDenied:
+		e.Table = firstSubmatch(mysqlDeniedRe, Msg)
+	}
+}
+
+func classifyPgError(e *DbError, pgErr *pq.Error) {
+	e.Code = string(pgErr.Code)
+	e.Kind = dbErrorKindPg[pgErr.Code.Name()]
+	if e.Kind == DbErrUnknown && pgErr.Code.Class() == "08" {
+		e.Kind = DbErrConnectionLost
+	}
+	e.Constraint = pgErr.Constraint
+	e.Table = pgErr.Table
+	e.Column = pgErr.Column
+}
+
+// AsDbError classifies err, returning nil for a nil error. Errors which are
+// already a *DbError are returned as-is.
+func AsDbError(err error) *DbError {
+	if err == nil {
+		return nil
+	}
+	var Classified *DbError
+	if errors.As(err, &Classified) {
+		return Classified
+	}
+	Classified = &DbError{Err: err}
+	var myErr *mysql.MySQLError
+	var pgErr *pq.Error
+	switch {
+	case errors.As(err, &myErr):
+		classifyMysqlError(Classified, myErr)
+	case errors.As(err, &pgErr):
+		classifyPgError(Classified, pgErr)
+	case errors.Is(err, context.DeadlineExceeded):
+		Classified.Kind = DbErrTimeout
+	case isConnectionLoss(err):
+		Classified.Kind = DbErrConnectionLost
+	}
+	return Classified
+}
+
+func dbErrorOrNil(err error) error {
+	if err == nil {
+		return nil
+	}
+	return AsDbError(err)
+}
+
+func (dbh *DbHandle) ErrorKind(err error) DbErrorKind {
+	if err == nil {
+		return DbErrUnknown
+	}
+	return AsDbError(err).Kind
+}
+
+// ErrorType predates DbError and keeps its strings, which callers compare
+// against; use ErrorKind for the backend-neutral classification.
+func (dbh *DbHandle) ErrorType(err error) string {
+	var besterror string
+	if err == nil {
+		return ""
+	}
+	if isConnectionLoss(err) {
+		return "connection_lost"
+	}
+	switch dbh.dbtype {
+	case DbTypeMysql:
+		besterror = "err_mysql_unknown"
+		var mysqlError *mysql.MySQLError
+		if errors.As(err, &mysqlError) {
+			besterror = fmt.Sprintf("mysql_errno_%d", mysqlError.Number)
+			log.Debugf("mysql error number %d\n", mysqlError.Number)
+			switch mysqlError.Number {
+			case mysqlerr.ER_DUP_ENTRY:
+				return "duplicate_key"
+			case mysqlerr.ER_LOCK_DEADLOCK:
+				return "deadlock"
+			case mysqlerr.ER_LOCK_WAIT_TIMEOUT:
+				return "lock_timeout"
+			case mysqlerr.ER_CON_COUNT_ERROR, mysqlerr.ER_TOO_MANY_USER_CONNECTIONS:
+				return "too_many_connections"
+			}
+		} else {
+			log.Printf("We received an error of type '%T'\n", err)
+		}
+	case DbTypePostgres:
+		besterror = "err_pgsql_unknown"
+		var pgError *pq.Error
+		if errors.As(err, &pgError) {
+			Code := pgError.Code.Name()
+			log.Debugf("pq error: %s (class %s)\n", Code, pgError.Code.Class())
+			switch Code {
+			case "unique_violation":
+				return "duplicate_key"
+			case "deadlock_detected":
+				return "deadlock"
+			case "serialization_failure":
+				return "serialization_failure"
+			case "lock_not_available":
+				return "lock_timeout"
+			case "too_many_connections":
+				return "too_many_connections"
+			case "admin_shutdown", "crash_shutdown", "cannot_connect_now":
+				return "connection_lost"
+			}
+			if pgError.Code.Class() == "08" {
+				return "connection_lost"
+			}
+			return "err_pgsqlundef_" + Code
+		}
+	default:
+		return "err_unknown_db"
+	}
+	return besterror
+}
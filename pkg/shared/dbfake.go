@@ -0,0 +1,514 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A scriptable fake database, for exercising db code without a server. A section
+with dbtype=fake connects to the FakeDb named by its dbname (the section name if
+unset), creating it on first use; fakedialect=pgsql makes it act like Postgres,
+otherwise it acts like MySQL. In code:
+
+	Fake := shared.NewFakeDb("orders", shared.DbTypePostgres)
+	Fake.On(`SELECT id,name FROM markets`).Return([]string{"id", "name"}, []interface{}{1, "btc-usd"})
+	Fake.On(`INSERT INTO markets`).Fail(shared.FakeError(shared.DbTypePostgres, shared.DbErrDuplicateKey, ""))
+	dbh := Fake.Handle()
+	...
+	for _, v := range Fake.Calls() { ... }
+
+Each statement is matched against the scripted patterns in the order they were
+added; a response set Once() is used up by its first match. Unmatched statements
+succeed with no rows, except that an INSERT gets the next auto-increment id, as
+LastInsertId or (for Postgres RETURNING) as a one-row result. Strict makes
+unmatched statements fail instead, apart from BEGIN, COMMIT and ROLLBACK.
+*/
+
+type FakeCall struct {
+	Sql  string
+	Args []interface{}
+	At   time.Time
+}
+
+type FakeResponse struct {
+	pattern  *regexp.Regexp
+	args     []interface{}
+	columns  []string
+	rows     [][]driver.Value
+	err      error
+	insertId int64
+	affected int64
+	once     bool
+	used     bool
+	delay    time.Duration
+}
+
+type FakeDb struct {
+	Name    string
+	Dialect DbType
+	Strict  bool // Unscripted statements fail rather than succeed empty
+	lock    sync.Mutex
+	script  []*FakeResponse
+	calls   []FakeCall
+	autoId  int64
+	down    error
+}
+
+var fakeDbs = struct {
+	sync.Mutex
+	byName map[string]*FakeDb
+}{byName: make(map[string]*FakeDb)}
+
+type fakeDriver struct {
+	dialect DbType
+}
+
+func init() {
+	sql.Register("g76fake-mysql", &fakeDriver{dialect: DbTypeMysql})
+	sql.Register("g76fake-pgsql", &fakeDriver{dialect: DbTypePostgres})
+}
+
+func fakeDriverName(Dialect DbType) string {
+	if Dialect == DbTypePostgres {
+		return "g76fake-pgsql"
+	}
+	return "g76fake-mysql"
+}
+
+// NewFakeDb creates (or resets) the fake database called Name.
+func NewFakeDb(Name string, Dialect DbType) *FakeDb {
+	Fake := &FakeDb{Name: Name, Dialect: Dialect}
+	fakeDbs.Lock()
+	fakeDbs.byName[Name] = Fake
+	fakeDbs.Unlock()
+	return Fake
+}
+
+// LookupFakeDb finds the fake database called Name, creating it if need be.
+func LookupFakeDb(Name string, Dialect DbType) *FakeDb {
+	fakeDbs.Lock()
+	Fake, found := fakeDbs.byName[Name]
+	fakeDbs.Unlock()
+	if found {
+		return Fake
+	}
+	return NewFakeDb(Name, Dialect)
+}
+
+// Handle returns a connected DbHandle on this fake database.
+func (f *FakeDb) Handle() *DbHandle {
+	dbh := &DbHandle{Section: "fake:" + f.Name, DbName: f.Name, dbtype: f.Dialect, fake: true}
+	log.ErrorIff(dbh.Connect(), "connecting to fake db '%s'", f.Name)
+	return dbh
+}
+
+func (dbh *DbHandle) connectDbFake() error {
+	var err error
+	LookupFakeDb(dbh.DbName, dbh.dbtype)
+	dbh.DB, err = sql.Open(fakeDriverName(dbh.dbtype), dbh.DbName)
+	return err
+}
+
+// On scripts the response to statements matching the regexp Pattern.
+func (f *FakeDb) On(Pattern string) *FakeResponse {
+	Resp := &FakeResponse{pattern: regexp.MustCompile(Pattern)}
+	f.lock.Lock()
+	f.script = append(f.script, Resp)
+	f.lock.Unlock()
+	return Resp
+}
+
+// WithArgs narrows the match to statements run with exactly these arguments.
+func (r *FakeResponse) WithArgs(Args ...interface{}) *FakeResponse {
+	for _, v := range Args {
+		Val, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			panic(fmt.Sprintf("fake db: can't use %T as an argument: %s", v, err))
+		}
+		r.args = append(r.args, Val)
+	}
+	if r.args == nil {
+		r.args = []interface{}{}
+	}
+	return r
+}
+
+func fakeArgsEqual(Want, Got []interface{}) bool {
+	if len(Want) != len(Got) {
+		return false
+	}
+	for k := range Want {
+		if !reflect.DeepEqual(Want[k], Got[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return sets the result set; each row holds one value per column.
+func (r *FakeResponse) Return(Columns []string, Rows ...[]interface{}) *FakeResponse {
+	r.columns = Columns
+	for _, Row := range Rows {
+		var Values []driver.Value
+		for _, v := range Row {
+			Val, err := driver.DefaultParameterConverter.ConvertValue(v)
+			if err != nil {
+				panic(fmt.Sprintf("fake db: can't return %T: %s", v, err))
+			}
+			Values = append(Values, Val)
+		}
+		r.rows = append(r.rows, Values)
+	}
+	return r
+}
+
+func (r *FakeResponse) Fail(err error) *FakeResponse {
+	r.err = err
+	return r
+}
+
+func (r *FakeResponse) InsertId(Id int64) *FakeResponse {
+	r.insertId = Id
+	return r
+}
+
+func (r *FakeResponse) Affected(Rows int64) *FakeResponse {
+	r.affected = Rows
+	return r
+}
+
+func (r *FakeResponse) Delay(d time.Duration) *FakeResponse {
+	r.delay = d
+	return r
+}
+
+func (r *FakeResponse) Once() *FakeResponse {
+	r.once = true
+	return r
+}
+
+// SetDown makes every connection attempt, ping and statement fail with err,
+// until called again with nil.
+func (f *FakeDb) SetDown(err error) {
+	f.lock.Lock()
+	f.down = err
+	f.lock.Unlock()
+}
+
+func (f *FakeDb) Calls() []FakeCall {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]FakeCall{}, f.calls...)
+}
+
+// CallsMatching returns the recorded calls whose SQL matches Pattern.
+func (f *FakeDb) CallsMatching(Pattern string) []FakeCall {
+	Re := regexp.MustCompile(Pattern)
+	var Found []FakeCall
+	for _, v := range f.Calls() {
+		if Re.MatchString(v.Sql) {
+			Found = append(Found, v)
+		}
+	}
+	return Found
+}
+
+// Reset forgets the script and the recorded calls.
+func (f *FakeDb) Reset() {
+	f.lock.Lock()
+	f.script = nil
+	f.calls = nil
+	f.lock.Unlock()
+}
+
+// Transaction control is never scripted, even in Strict mode, unless a test
+// wants it to fail.
+var fakeTxControl = map[string]bool{"BEGIN": true, "COMMIT": true, "ROLLBACK": true}
+
+var fakeReturningRe = regexp.MustCompile(`(?i)\bRETURNING\s+(\w+)`)
+var fakeInsertRe = regexp.MustCompile(`(?i)^\s*INSERT\b`)
+
+// respond records the call and finds what to answer it with.
+func (f *FakeDb) respond(Sql string, Args []driver.Value) (*FakeResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	Call := FakeCall{Sql: Sql, At: time.Now()}
+	for _, v := range Args {
+		Call.Args = append(Call.Args, v)
+	}
+	f.calls = append(f.calls, Call)
+	if f.down != nil {
+		return nil, f.down
+	}
+	for _, Resp := range f.script {
+		if Resp.used || !Resp.pattern.MatchString(Sql) {
+			continue
+		}
+		if Resp.args != nil && !fakeArgsEqual(Resp.args, Call.Args) {
+			continue
+		}
+		if Resp.once {
+			Resp.used = true
+		}
+		if Resp.insertId == 0 && Resp.err == nil && fakeInsertRe.MatchString(Sql) {
+			f.autoId++
+			Copy := *Resp
+			Copy.insertId = f.autoId
+			return &Copy, nil
+		}
+		return Resp, nil
+	}
+	if f.Strict && !fakeTxControl[Sql] {
+		return nil, fmt.Errorf("fake db '%s': no scripted response for: %s", f.Name, Sql)
+	}
+	Resp := &FakeResponse{}
+	if fakeInsertRe.MatchString(Sql) {
+		f.autoId++
+		Resp.insertId, Resp.affected = f.autoId, 1
+		if Match := fakeReturningRe.FindStringSubmatch(Sql); Match != nil {
+			Resp.columns = []string{Match[1]}
+			Resp.rows = [][]driver.Value{{f.autoId}}
+		}
+	}
+	return Resp, nil
+}
+
+func (d *fakeDriver) Open(Name string) (driver.Conn, error) {
+	Fake := LookupFakeDb(Name, d.dialect)
+	Fake.lock.Lock()
+	Down := Fake.down
+	Fake.lock.Unlock()
+	if Down != nil {
+		return nil, Down
+	}
+	return &fakeConn{db: Fake}, nil
+}
+
+type fakeConn struct {
+	db *FakeDb
+}
+
+func (c *fakeConn) Prepare(Query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, sql: Query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	_, err := c.db.respond("BEGIN", nil)
+	return &fakeTx{conn: c}, err
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if c.db.down != nil {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (t *fakeTx) Commit() error {
+	_, err := t.conn.db.respond("COMMIT", nil)
+	return err
+}
+
+func (t *fakeTx) Rollback() error {
+	_, err := t.conn.db.respond("ROLLBACK", nil)
+	return err
+}
+
+type fakeStmt struct {
+	conn *fakeConn
+	sql  string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) run(Args []driver.Value) (*FakeResponse, error) {
+	Resp, err := s.conn.db.respond(s.sql, Args)
+	if err != nil {
+		return nil, err
+	}
+	if Resp.delay > 0 {
+		time.Sleep(Resp.delay)
+	}
+	return Resp, Resp.err
+}
+
+func (s *fakeStmt) Exec(Args []driver.Value) (driver.Result, error) {
+	Resp, err := s.run(Args)
+	if err != nil {
+		return nil, err
+	}
+	Affected := Resp.affected
+	if Affected == 0 && Resp.insertId != 0 {
+		Affected = 1
+	}
+	return fakeResult{insertId: Resp.insertId, affected: Affected}, nil
+}
+
+func (s *fakeStmt) Query(Args []driver.Value) (driver.Rows, error) {
+	Resp, err := s.run(Args)
+	if err != nil {
+		return nil, err
+	}
+	Rows := Resp.rows
+	Columns := Resp.columns
+	if Columns == nil && Resp.insertId != 0 {
+		if Match := fakeReturningRe.FindStringSubmatch(s.sql); Match != nil {
+			Columns = []string{Match[1]}
+			Rows = [][]driver.Value{{Resp.insertId}}
+		}
+	}
+	return &fakeRows{columns: Columns, rows: Rows, dialect: s.conn.db.Dialect}, nil
+}
+
+type fakeResult struct {
+	insertId int64
+	affected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.insertId, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.affected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	pos     int
+	dialect DbType
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(Dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(Dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+// ColumnTypeScanType reports types the way the real drivers do for nullable
+// columns, so sjson.ScanRows can handle fake results.
+func (r *fakeRows) ColumnTypeScanType(Index int) reflect.Type {
+	for _, Row := range r.rows {
+		if Index >= len(Row) || Row[Index] == nil {
+			continue
+		}
+		switch Row[Index].(type) {
+		case int64:
+			return reflect.TypeOf(sql.NullInt64{})
+		case float64:
+			return reflect.TypeOf(sql.NullFloat64{})
+		case bool:
+			return reflect.TypeOf(false)
+		case time.Time:
+			return reflect.TypeOf(time.Time{})
+		}
+		break
+	}
+	return reflect.TypeOf("")
+}
+
+// ColumnTypeDatabaseTypeName calls time columns what the dialect's zone-less
+// type is called, so the time codec sees them as it would the real thing.
+func (r *fakeRows) ColumnTypeDatabaseTypeName(Index int) string {
+	if r.ColumnTypeScanType(Index) != reflect.TypeOf(time.Time{}) {
+		return ""
+	}
+	if r.dialect == DbTypePostgres {
+		return "TIMESTAMP"
+	}
+	return "DATETIME"
+}
+
+var fakeMysqlErrno = map[DbErrorKind]uint16{
+	DbErrDuplicateKey:        mysqlerr.ER_DUP_ENTRY,
+	DbErrForeignKeyViolation: mysqlerr.ER_NO_REFERENCED_ROW_2,
+	DbErrNotNullViolation:    mysqlerr.ER_BAD_NULL_ERROR,
+	DbErrCheckViolation:      mysqlerr.ER_CHECK_CONSTRAINT_VIOLATED,
+	DbErrDeadlock:            mysqlerr.ER_LOCK_DEADLOCK,
+	DbErrTimeout:             mysqlerr.ER_LOCK_WAIT_TIMEOUT,
+	DbErrSyntax:              mysqlerr.ER_PARSE_ERROR,
+	DbErrPermissionDenied:    mysqlerr.ER_TABLEACCESS_DENIED_ERROR,
+	DbErrTooManyConnections:  mysqlerr.ER_CON_COUNT_ERROR,
+}
+
+var fakePgCode = map[DbErrorKind]string{
+	DbErrDuplicateKey:         "23505",
+	DbErrForeignKeyViolation:  "23503",
+	DbErrNotNullViolation:     "23502",
+	DbErrCheckViolation:       "23514",
+	DbErrDeadlock:             "40P01",
+	DbErrSerializationFailure: "40001",
+	DbErrTimeout:              "57014",
+	DbErrSyntax:               "42601",
+	DbErrPermissionDenied:     "42501",
+	DbErrTooManyConnections:   "53300",
+	DbErrConnectionLost:       "08006",
+}
+
+// FakeError builds the error the real driver for Dialect would return for Kind,
+// so ErrorKind, ErrorType and the retry logic treat it as the real thing.
+// ConnectionLost is what each driver reports for a connection dropped mid-query,
+// not driver.ErrBadConn, which database/sql would quietly retry itself. A kind
+// the dialect has no code for comes back as a plain error.
+func FakeError(Dialect DbType, Kind DbErrorKind, Message string) error {
+	if Kind == DbErrConnectionLost && Dialect != DbTypePostgres {
+		return mysql.ErrInvalidConn
+	}
+	if Message == "" {
+		Message = "fake " + Kind.String()
+		if Kind == DbErrDuplicateKey && Dialect == DbTypeMysql {
+			Message = "Duplicate entry 'fake' for key 'fake_key'"
+		}
+	}
+	switch Dialect {
+	case DbTypeMysql:
+		if Errno, found := fakeMysqlErrno[Kind]; found {
+			return &mysql.MySQLError{Number: Errno, Message: Message}
+		}
+	case DbTypePostgres:
+		if Code, found := fakePgCode[Kind]; found {
+			return &pq.Error{Severity: "ERROR", Code: pq.ErrorCode(Code), Message: Message}
+		}
+	}
+	return fmt.Errorf("%s", strings.TrimSpace(Message))
+}
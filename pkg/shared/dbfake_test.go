@@ -0,0 +1,218 @@
+package shared
+
+import (
+	"testing"
+)
+
+/*
+These run against the fake driver in dbfake.go; no database is needed.
+*/
+
+func TestErrorType(t *testing.T) {
+	Cases := []struct {
+		Dialect DbType
+		Kind    DbErrorKind
+		Want    string
+	}{
+		{DbTypeMysql, DbErrDuplicateKey, "duplicate_key"},
+		{DbTypeMysql, DbErrDeadlock, "deadlock"},
+		{DbTypeMysql, DbErrTimeout, "lock_timeout"},
+		{DbTypeMysql, DbErrTooManyConnections, "too_many_connections"},
+		{DbTypeMysql, DbErrConnectionLost, "connection_lost"},
+		{DbTypeMysql, DbErrSyntax, "mysql_errno_1064"},
+		{DbTypePostgres, DbErrDuplicateKey, "duplicate_key"},
+		{DbTypePostgres, DbErrDeadlock, "deadlock"},
+		{DbTypePostgres, DbErrSerializationFailure, "serialization_failure"},
+		{DbTypePostgres, DbErrTooManyConnections, "too_many_connections"},
+		{DbTypePostgres, DbErrConnectionLost, "connection_lost"},
+		{DbTypePostgres, DbErrSyntax, "err_pgsqlundef_syntax_error"},
+	}
+	for _, c := range Cases {
+		Fake := NewFakeDb(t.Name(), c.Dialect)
+		Fake.On(`^INSERT INTO t`).Fail(FakeError(c.Dialect, c.Kind, ""))
+		dbh := Fake.Handle()
+		Query := "INSERT INTO t (name) VALUES (?);"
+		if c.Dialect == DbTypePostgres {
+			Query = "INSERT INTO t (name) VALUES ($1);"
+		}
+		_, err := dbh.PrepareOrDie(Query).Exec("x")
+		if err == nil {
+			t.Errorf("%d %s: no error from a scripted failure", c.Dialect, c.Kind)
+			continue
+		}
+		if Got := dbh.ErrorType(err); Got != c.Want {
+			t.Errorf("%d %s: ErrorType is '%s', want '%s'", c.Dialect, c.Kind, Got, c.Want)
+		}
+		if Got := dbh.ErrorKind(err); Got != c.Kind {
+			t.Errorf("%d %s: ErrorKind is %s", c.Dialect, c.Kind, Got)
+		}
+		dbh.Close()
+	}
+	if Got := NewFakeDb(t.Name(), DbTypeMysql).Handle().ErrorType(nil); Got != "" {
+		t.Errorf("ErrorType(nil) is '%s'", Got)
+	}
+}
+
+func TestRunAndGetLastInsertId(t *testing.T) {
+	Fake := NewFakeDb(t.Name()+"-mysql", DbTypeMysql)
+	Fake.On(`^INSERT INTO orders`).InsertId(42)
+	dbh := Fake.Handle()
+	defer dbh.Close()
+	Id, err := RunAndGetLastInsertId(dbh.PrepareOrDie("INSERT INTO orders (market) VALUES (?);"), "btc-usd")
+	if err != nil || Id != 42 {
+		t.Errorf("mysql: got %d, %v; want 42", Id, err)
+	}
+
+	Fake = NewFakeDb(t.Name()+"-pgsql", DbTypePostgres)
+	dbh = Fake.Handle()
+	defer dbh.Close()
+	Stmt := dbh.PrepareOrDie("INSERT INTO orders (market) VALUES ($1) RETURNING id;")
+	for Want := int64(1); Want <= 2; Want++ {
+		Id, err = RunAndGetLastInsertId(Stmt, "btc-usd")
+		if err != nil || Id != Want {
+			t.Errorf("pgsql: got %d, %v; want %d", Id, err, Want)
+		}
+	}
+	if Calls := Fake.CallsMatching(`^INSERT INTO orders`); len(Calls) != 2 || Calls[0].Args[0] != "btc-usd" {
+		t.Errorf("pgsql: calls were %+v", Calls)
+	}
+}
+
+func TestNewLookup(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Fake.On(`^SELECT id,name FROM markets`).Return([]string{"id", "name"},
+		[]interface{}{int64(1), "btc-usd"}, []interface{}{int64(2), "eth-usd"})
+	Fake.On(`^INSERT INTO markets`).Return([]string{"id"}, []interface{}{int64(3)})
+	dbh := Fake.Handle()
+	defer dbh.Close()
+	Markets := NewLookup("markets", dbh)
+
+	if Item := Markets.ByName("eth-usd"); Item.IsNil() || Item.Id() != 2 {
+		t.Errorf("ByName(eth-usd) is %+v", Item)
+	}
+	if Item := Markets.ById(1); Item.IsNil() || Item.Name() != "btc-usd" {
+		t.Errorf("ById(1) is %+v", Item)
+	}
+	if Item := Markets.ByName("sol-usd"); !Item.IsNil() {
+		t.Errorf("ByName of a missing name is %+v", Item)
+	}
+	if Item := Markets.LabelToId("sol-usd", false); Item != nil {
+		t.Errorf("LabelToId of a missing name is %#v, not nil", Item)
+	}
+	if Item := Markets.(*lookupTable).ByNameOrDie("sol-usd"); Item == nil || !Item.IsNil() {
+		t.Errorf("ByNameOrDie of a missing name is %#v, not a nil *lookupMember", Item)
+	}
+	if Item := Markets.ByNameOrAdd("sol-usd"); Item.IsNil() || Item.Id() != 3 {
+		t.Errorf("ByNameOrAdd(sol-usd) is %+v", Item)
+	}
+	Fake.Reset()
+	if Item := Markets.ByName("sol-usd"); Item.IsNil() {
+		t.Errorf("an added name wasn't kept")
+	}
+	if Calls := Fake.Calls(); len(Calls) != 0 {
+		t.Errorf("cached names went to the db: %+v", Calls)
+	}
+	if len(Markets.Items()) != 3 {
+		t.Errorf("Items() is %+v", Markets.Items())
+	}
+}
+
+func TestLiveConfig(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Fake.On(`^SELECT label, updated, content FROM liveconfig`).Return([]string{"label", "updated", "content"},
+		[]interface{}{"motd", "2024-01-01 00:00:00", "hello"},
+		[]interface{}{"unbound", "2024-01-01 00:00:00", "ignored"})
+	Fake.On(`^SELECT content FROM liveconfig WHERE label`).WithArgs("motd").Return([]string{"content"},
+		[]interface{}{"hello"})
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	var Motd string
+	Lc := NewLiveConfig().BindDb(dbh)
+	Key := Lc.Bind("motd", &Motd)
+	if err := Lc.checkConfigs(); err != nil {
+		t.Fatalf("checkConfigs: %s", err)
+	}
+	if Motd != "hello" || Key.Version != 1 {
+		t.Errorf("after load, motd is '%s' at version %d", Motd, Key.Version)
+	}
+
+	Motd = "bye"
+	if err := Key.Replicate(); err != nil {
+		t.Fatalf("Replicate: %s", err)
+	}
+	Calls := Fake.CallsMatching(`^UPDATE liveconfig`)
+	if len(Calls) != 1 || Calls[0].Args[0] != "motd" || Calls[0].Args[1] != "bye" {
+		t.Errorf("Replicate sent %+v", Calls)
+	}
+}
+
+func TestScanRows(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypeMysql)
+	Fake.On(`^SELECT id, name, price FROM markets`).Return([]string{"id", "name", "price"},
+		[]interface{}{int64(1), "btc-usd", 41000.5},
+		[]interface{}{int64(2), "eth-usd", nil})
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	Rows, err := dbh.DB.Query("SELECT id, name, price FROM markets;")
+	if err != nil {
+		t.Fatalf("query: %s", err)
+	}
+	defer Rows.Close()
+	Result, err := dbh.ScanRows(Rows)
+	if err != nil {
+		t.Fatalf("ScanRows: %s", err)
+	}
+	if len(Result) != 2 {
+		t.Fatalf("got %d rows: %+v", len(Result), Result)
+	}
+	if Result[0]["id"] != int64(1) || Result[0]["name"] != "btc-usd" || Result[0]["price"] != 41000.5 {
+		t.Errorf("row 0 is %#v", Result[0])
+	}
+	if Result[1]["name"] != "eth-usd" || Result[1]["price"] != nil {
+		t.Errorf("row 1 is %#v", Result[1])
+	}
+}
+
+func TestFakeStrictTx(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Fake.Strict = true
+	Fake.On(`^UPDATE markets`).Affected(1)
+	dbh := Fake.Handle()
+	defer dbh.Close()
+	err := dbh.WithTx(nil, nil, func(tx *Tx) error {
+		_, err := tx.ExecContext(tx.Context(), "UPDATE markets SET name=$1;", "x")
+		return err
+	})
+	if err != nil {
+		t.Errorf("transaction in strict mode: %s", err)
+	}
+	if _, err = dbh.DB.Exec("DELETE FROM markets;"); err == nil {
+		t.Errorf("strict mode let an unscripted DELETE through")
+	}
+}
+
+func TestRetryPolicyBounds(t *testing.T) {
+	dbh := NewFakeDb(t.Name(), DbTypePostgres).Handle()
+	defer dbh.Close()
+	Deadlock := FakeError(DbTypePostgres, DbErrDeadlock, "")
+	for _, c := range []struct {
+		Policy RetryPolicy
+		Want   int
+	}{
+		{RetryPolicy{MaxAttempts: 3, RetryOn: []DbErrorKind{DbErrDeadlock}}, 3},
+		{RetryPolicy{RetryOn: []DbErrorKind{DbErrDeadlock}}, 1},
+	} {
+		Policy := c.Policy
+		dbh.SetRetryPolicy(&Policy)
+		var Calls int
+		err := dbh.WithRetry("deadlocks", func() error {
+			Calls++
+			return Deadlock
+		})
+		if err == nil || Calls != c.Want {
+			t.Errorf("%+v: %d calls, err %v; want %d calls", c.Policy, Calls, err, c.Want)
+		}
+	}
+}
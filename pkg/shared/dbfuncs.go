@@ -1,15 +1,16 @@
 package shared
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"github.com/VividCortex/mysqlerr"
-	"github.com/go-sql-driver/mysql"
 	"github.com/grammaton76/g76golib/pkg/sjson"
-	"github.com/lib/pq"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,26 +35,67 @@ type Stmt struct {
 	sql      string
 	argorder []int
 	failure  error
+	tx       *Tx
+	prepLock sync.RWMutex
+
+	route        stmtRoute
+	base         *Stmt // What a routed view (FromReplica, FromPrimary) was made from
+	routes       [3]*Stmt
+	replicaStmts map[*dbReplica]*sql.Stmt
+	replicaLock  sync.Mutex
+
+	warnedUnmapped int32 // Set atomically, once the unmapped columns have been logged
+
+	cacheTTL    time.Duration
+	cacheTags   []string
+	invalidates []string
 }
 
 type DbHandle struct {
 	*sql.DB
-	Name      string
-	Section   string // Section that the config settings came from
-	Key       string // Config key pointing to the section (i.e. scraper.dbhandle=scrapedb; that points at the section)
-	dbtype    DbType
-	Host      string
-	DbName    string
-	Username  string
-	Password  string
-	ReadOnly  bool
-	warnings  []error
-	failed    error
-	prepCache map[string]*sql.Stmt
+	Name       string
+	Section    string // Section that the config settings came from
+	Key        string // Config key pointing to the section (i.e. scraper.dbhandle=scrapedb; that points at the section)
+	dbtype     DbType
+	Host       string
+	DbName     string
+	Username   string
+	Password   string
+	ReadOnly   bool
+	LeaseLocks bool // Locks use DbLeaseTable even where the dialect has its own
+	warnings   []error
+	failed     error
+	prepCache  *prepCache
+	retry      *RetryPolicy
+
+	QueryTimeout time.Duration // Default statement timeout; the ini's querytimeout
+	SlowQuery    time.Duration // Statements slower than this get logged; the ini's slowquery
+	stats        dbStats
+	ReplicaHosts []string      // From the ini's replicas=host1,host2
+	ReplicaCheck time.Duration // Replica health check interval
+	replicas     []*dbReplica
+	replicaNext  uint32
+	replicaLock  sync.RWMutex
+	replicaStop  chan struct{}
+	baseCtx      context.Context
+	baseCancel   context.CancelFunc
+	ctxLock      sync.Mutex
+	registered   []*Stmt // From PrepareAll
+	registryLock sync.Mutex
+	Monitor      time.Duration // Health monitor interval; the ini's monitor
+	MonitorAlert time.Duration // Downtime before alerting; the ini's monitoralert
+	monitor      *dbMonitor
+	monitorLock  sync.Mutex
+	fake         bool           // dbtype=fake; dbtype is then the dialect it emulates
+	TimeZone     *time.Location // Zone the database keeps times in; the ini's timezone. Local if nil.
+	config       *Configuration // Where the credentials came from, for rotation
+	rotation     dbRotation
+	results      *resultCache
+	resultsLock  sync.Mutex
 }
 
 func (sth *Stmt) Err() error {
-	return sth.failure
+	return sth.prepErr()
 }
 
 func (sth *Stmt) Identify() string {
@@ -122,29 +164,41 @@ func (dbh *DbHandle) Identifier() string {
 
 func (dbh *DbHandle) Connect() error {
 	var err error
-	switch dbh.dbtype {
-	case DbTypeMysql:
+	switch {
+	case dbh.fake:
+		err = dbh.connectDbFake()
+	case dbh.dbtype == DbTypeMysql:
 		err = dbh.connectDbMysql()
-	case DbTypePostgres:
+	case dbh.dbtype == DbTypePostgres:
 		err = dbh.connectDbPg()
 	default:
 		log.Fatalf("Attempted to call connect on '%s' when we had no db type - '%s'!\n", dbh.Identifier(), dbh.failed)
 	}
+	if err == nil && len(dbh.replicas) == 0 {
+		dbh.connectReplicas()
+	}
+	if err == nil {
+		// Cached and registered statements belong to the old pool; point them at the new one.
+		dbh.RePrepareAll(nil)
+	}
 	return err
 }
 
-func (dbh *DbHandle) connectDbMysql() error {
-	var Dsn string
+func (dbh *DbHandle) mysqlDsn(Host string) string {
+	User, Pass := dbh.credentials()
 	if dbh.DbName != "" {
-		Dsn = fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true&charset=utf8mb4_general_ci,utf8&loc=%s",
-			dbh.Username, dbh.Password, dbh.Host, dbh.DbName, time.Local.String())
-	} else {
-		Dsn = fmt.Sprintf("%s:%s@tcp(%s:3306)/?parseTime=true&charset=utf8mb4_general_ci,utf8&loc=%s",
-			dbh.Username, dbh.Password, dbh.Host, time.Local.String())
+		return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true&charset=utf8mb4_general_ci,utf8&loc=%s",
+			User, Pass, Host, dbh.DbName, url.QueryEscape(dbh.mysqlLocation()))
 	}
+	return fmt.Sprintf("%s:%s@tcp(%s:3306)/?parseTime=true&charset=utf8mb4_general_ci,utf8&loc=%s",
+		User, Pass, Host, url.QueryEscape(dbh.mysqlLocation()))
+}
+
+func (dbh *DbHandle) connectDbMysql() error {
+	Dsn := dbh.mysqlDsn(dbh.Host)
 	// fmt.Printf("Host: '%s', database: '%s', user: '%s'\n", DbHost, DbName, DbUser)
 	var err error
-	dbh.DB, err = sql.Open("mysql", Dsn)
+	dbh.DB, dbh.rotation.connector, err = openPool(DbTypeMysql, Dsn)
 	dbh.dbtype = DbTypeMysql
 	if err != nil {
 		dbh.failed = err
@@ -153,23 +207,32 @@ func (dbh *DbHandle) connectDbMysql() error {
 	return dbh.failed
 }
 
-func (dbh *DbHandle) connectDbPg() error {
+func (dbh *DbHandle) pgDsn(Host string) string {
 	var Dsn string
-	if dbh.Username != "" {
-		Dsn += fmt.Sprintf("user=%s ", dbh.Username)
+	User, Pass := dbh.credentials()
+	if User != "" {
+		Dsn += fmt.Sprintf("user=%s ", User)
 	}
 	if dbh.DbName != "" {
 		Dsn += fmt.Sprintf("dbname=%s ", dbh.DbName)
 	}
 	Dsn += fmt.Sprintf("sslmode=disable ")
-	if dbh.Password != "" {
-		Dsn += fmt.Sprintf("password=%s ", dbh.Password)
+	if Pass != "" {
+		Dsn += fmt.Sprintf("password=%s ", Pass)
+	}
+	if Host != "" {
+		Dsn += fmt.Sprintf("host=%s ", Host)
 	}
-	if dbh.Host != "" {
-		Dsn += fmt.Sprintf("host=%s ", dbh.Host)
+	if dbh.TimeZone != nil {
+		Dsn += fmt.Sprintf("timezone=%s ", dbh.TimeZone.String())
 	}
+	return Dsn
+}
+
+func (dbh *DbHandle) connectDbPg() error {
+	Dsn := dbh.pgDsn(dbh.Host)
 	var err error
-	dbh.DB, err = sql.Open("postgres", Dsn)
+	dbh.DB, dbh.rotation.connector, err = openPool(DbTypePostgres, Dsn)
 	dbh.dbtype = DbTypePostgres
 	if err != nil {
 		dbh.failed = err
@@ -179,24 +242,34 @@ func (dbh *DbHandle) connectDbPg() error {
 	return dbh.failed
 }
 
+// RunAndGetLastInsertId dies on a database error, as it always has, except
+// when the statement was cancelled (by CancelInFlight, say); that's returned.
 func RunAndGetLastInsertId(stmt *Stmt, Options ...interface{}) (int64, error) {
+	Id, err := RunAndGetLastInsertIdContext(nil, stmt, Options...)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		log.Fatalf("%s\n", err)
+	}
+	return Id, err
+}
+
+// RunAndGetLastInsertIdContext runs an insert and returns the id it was given:
+// LastInsertId on MySQL, the RETURNING column on Postgres.
+func RunAndGetLastInsertIdContext(ctx context.Context, stmt *Stmt, Options ...interface{}) (int64, error) {
 	switch stmt.dbh.dbtype {
 	case DbTypeMysql:
-		res, err := stmt.Exec(Options...)
+		res, err := stmt.ExecContext(ctx, Options...)
 		if err != nil {
-			log.Fatalf("ERROR on chat.chatMessageInsert: %s\n", err)
+			return 0, fmt.Errorf("inserting %s: %w", stmt.Identify(), err)
 		}
-		row, err := res.LastInsertId()
-		return row, err
+		return res.LastInsertId()
 	case DbTypePostgres:
 		var row *int64
-		var err error
-		err = stmt.QueryRow(Options...).Scan(&row)
+		err := stmt.QueryRowContext(ctx, Options...).Scan(&row)
 		if err != nil {
-			log.Fatalf("In chat.chatMessageInsert: %s (or id scan thereof): %s\n", stmt.Identify(), err)
+			return 0, fmt.Errorf("inserting %s (or id scan thereof): %w", stmt.Identify(), err)
 		}
 		if row == nil {
-			log.Errorf("Null result back from QueryRow, but no error set; unclear if the database worked or not.\n")
+			return 0, fmt.Errorf("inserting %s: RETURNING gave a NULL id", stmt.Identify())
 		}
 		return *row, nil
 	}
@@ -204,24 +277,10 @@ func RunAndGetLastInsertId(stmt *Stmt, Options ...interface{}) (int64, error) {
 }
 
 func InsertJsonAsDbRow(Table string, Data *sjson.JSON, Db *sql.DB) error {
-	var Cols []string
-	var Placeholders []string
-	var Vals []interface{}
-	for k, v := range *Data {
-		Cols = append(Cols, k)
-		Placeholders = append(Placeholders, "?")
-		Vals = append(Vals, v)
-	}
-	Query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);", Table,
-		strings.Join(Cols, ","),
-		strings.Join(Placeholders, ","),
-	)
-	Stmt, err := Db.Prepare(Query)
-	log.FatalIff(err, "InsertJsonAsDbRow failed prepare on table '%s' with query '%s'", Table, Query)
-	_, err = Stmt.Exec(Vals...)
-	Stmt.Close()
-	log.ErrorIff(err, "InsertJsonAsDbRow failed exec on table '%s' with query '%s'", Table, Query)
-	return nil
+	ib := &insertBuilder{Db: Db, Type: dbTypeOfDriver(Db), Table: Table}
+	_, err := ib.run(nil, nil, sjson.JSONarray{*Data})
+	log.ErrorIff(err, "InsertJsonAsDbRow failed on table '%s'", Table)
+	return err
 }
 
 var transToPsql sjson.JSON
@@ -253,10 +312,21 @@ func (dbh *DbHandle) TransPrep(sql string) *Stmt {
 }
 
 func (dbh *DbHandle) Prepare(sql string) *Stmt {
+	return dbh.PrepareContext(nil, sql)
+}
+
+func (dbh *DbHandle) PrepareContext(ctx context.Context, sql string) *Stmt {
 	if dbh == nil {
 		log.Fatalf("ERROR: Prepare for '%s' called with a nil database handle!\n", sql)
 	}
-	stmt, err := dbh.DB.Prepare(sql)
+	if dbh.prepCache != nil {
+		if Cached := dbh.prepCache.get(sql); Cached != nil {
+			return Cached
+		}
+	}
+	ctx, cancel := dbh.statementContext(ctx)
+	defer cancel()
+	stmt, err := dbh.DB.PrepareContext(ctx, sql)
 	log.Debugf("DB '%s': Prepare'ing query '%s'\n", dbh.Identifier(), sql)
 	/*	if dbh.dbtype==DbTypeMysql {
 		var KeepGoing=true
@@ -272,68 +342,208 @@ func (dbh *DbHandle) Prepare(sql string) *Stmt {
 	Bob.Stmt = stmt
 	Bob.sql = sql
 	Bob.failure = err
+	if err == nil && dbh.prepCache != nil {
+		return dbh.prepCache.put(&Bob)
+	}
 	return &Bob
 }
 
 func (sth *Stmt) OrDie(msgs ...string) *Stmt {
-	log.FatalIff(sth.failure, "Failed to prepare statement: %s\nSQL: %s\n%s\n",
+	log.FatalIff(sth.prepErr(), "Failed to prepare statement: %s\nSQL: %s\n%s\n",
 		sth.dbh.Identifier(), sth.sql, strings.Join(msgs, "\n"))
 	return sth
 }
 
+func (sth *Stmt) orderArgs(args []interface{}) []interface{} {
+	if len(sth.argorder) == 0 {
+		return args
+	}
+	var nargs []interface{}
+	for _, v := range sth.argorder {
+		nargs = append(nargs, args[v])
+	}
+	return nargs
+}
+
+// Statements inside a transaction can't be retried on their own; WithTx
+// retries the transaction as a whole instead.
+func (sth *Stmt) withRetry(ctx context.Context, IsWrite bool, Fn func() error) error {
+	if sth.tx != nil {
+		return Fn()
+	}
+	return sth.dbh.withRetry(ctx, sth.sql, IsWrite, Fn)
+}
+
+func (sth *Stmt) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil && sth.tx != nil {
+		ctx = sth.tx.ctx
+	}
+	return sth.dbh.statementContext(ctx)
+}
+
 func (sth *Stmt) Exec(args ...interface{}) (sql.Result, error) {
-	Argc := len(sth.argorder)
-	if Argc > 0 {
-		var nargs []interface{}
-		for _, v := range sth.argorder {
-			nargs = append(nargs, args[v])
+	return sth.ExecContext(nil, args...)
+}
+
+func (sth *Stmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	if err := sth.prepErr(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := sth.context(ctx)
+	defer cancel()
+	Started := time.Now()
+	var Res sql.Result
+	err := sth.withRetry(ctx, true, func() error {
+		return sth.runPrepared(ctx, func(stmt *sql.Stmt) error {
+			var err error
+			Res, err = stmt.ExecContext(ctx, sth.orderArgs(args)...)
+			return err
+		})
+	})
+	var Affected int64
+	if err == nil {
+		Affected, _ = Res.RowsAffected()
+		if len(sth.invalidates) > 0 && sth.tx != nil {
+			sth.tx.invalidateOnCommit(sth.invalidates...)
+		} else if len(sth.invalidates) > 0 {
+			sth.dbh.InvalidateCacheTag(sth.invalidates...)
 		}
-		return sth.Stmt.Exec(nargs)
 	}
-	return sth.Stmt.Exec(args...)
+	sth.record(Started, Affected, err, args)
+	return Res, dbErrorOrNil(err)
 }
 
-func PrepareOrDie(dbh *DbHandle, sql string) *Stmt {
-	if dbh == nil {
-		log.Fatalf("Prepare for '%s' called with a nil database handle!\n", sql)
+func (sth *Stmt) Query(args ...interface{}) (*sql.Rows, error) {
+	return sth.QueryContext(nil, args...)
+}
+
+// QueryContext's timeout, if any, covers reading the rows too; it is released
+// when it fires rather than when the rows are closed. It always goes to the
+// database; QueryRows is the one which uses the result cache.
+func (sth *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	if err := sth.prepErr(); err != nil {
+		return nil, err
 	}
-	Caw := dbh.Prepare(sql).OrDie()
-	return Caw
+	return sth.queryDirect(ctx, args)
 }
 
-func (dbh *DbHandle) ErrorType(err error) string {
-	var besterror string
-	if err == nil {
-		return ""
+func (sth *Stmt) queryDirect(ctx context.Context, args []interface{}) (*sql.Rows, error) {
+	ctx, cancel := sth.context(ctx)
+	Started := time.Now()
+	var Rows *sql.Rows
+	err := sth.withRetry(ctx, false, func() error {
+		Run := func(stmt *sql.Stmt) error {
+			var err error
+			Rows, err = stmt.QueryContext(ctx, sth.orderArgs(args)...)
+			return err
+		}
+		if Handled, err := sth.onReplica(ctx, Run); Handled {
+			return err
+		}
+		return sth.runPrepared(ctx, Run)
+	})
+	sth.record(Started, 0, err, args)
+	if err != nil {
+		cancel()
+		return nil, dbErrorOrNil(err)
 	}
-	switch dbh.dbtype {
-	case DbTypeMysql:
-		besterror = "err_mysql_unknown"
-		if mysqlError, ok := err.(*mysql.MySQLError); ok {
-			besterror = fmt.Sprintf("mysql_errno_%d", mysqlError)
-			log.Debugf("mysql error number %d\n", mysqlError)
-			if mysqlError.Number == mysqlerr.ER_DUP_ENTRY {
-				return "duplicate_key"
-			}
-		} else {
-			log.Printf("We received an error of type '%T'\n", err)
+	sth.dbh.cancelAfterTimeout(cancel)
+	return Rows, nil
+}
+
+// Row is what FetchRow returns; like *sql.Row, but its errors come back
+// classified as *DbError.
+type Row struct {
+	row    *sql.Row
+	cached *CachedRows // From the result cache, instead of row
+	err    error
+}
+
+// Scan is sql.Row's Scan, except that errors are DbErrors; sql.ErrNoRows is
+// passed through as is, since callers compare against it.
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.cached != nil {
+		defer r.cached.Close()
+		if !r.cached.Next() {
+			return sql.ErrNoRows
 		}
-	case DbTypePostgres:
-		besterror = "err_pgsql_unknown"
-		if pgError, ok := err.(*pq.Error); ok {
-			Code := pgError.Code.Name()
-			log.Debugf("pq error: %s (class %s)\n", Code, pgError.Code.Class())
-			switch Code {
-			case "unique_violation":
-				return "duplicate_key"
-			default:
-				return "err_pgsqlundef_" + Code
-			}
+		return r.cached.Scan(dest...)
+	}
+	err := r.row.Scan(dest...)
+	if err == sql.ErrNoRows {
+		return err
+	}
+	return dbErrorOrNil(err)
+}
+
+func (r *Row) Err() error {
+	if r.err != nil || r.cached != nil {
+		return r.err
+	}
+	return dbErrorOrNil(r.row.Err())
+}
+
+func (sth *Stmt) QueryRow(args ...interface{}) *sql.Row {
+	return sth.QueryRowContext(nil, args...)
+}
+
+// QueryRowContext is sql.Stmt's, with the handle's timeout, retry and
+// replica routing. A statement which failed to prepare is sent unprepared,
+// so that the row carries the database's error. It always goes to the
+// database; FetchRow is the one which uses the result cache.
+func (sth *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row {
+	ctx, cancel := sth.context(ctx)
+	sth.dbh.cancelAfterTimeout(cancel)
+	if sth.prepErr() != nil {
+		return sth.dbh.DB.QueryRowContext(ctx, sth.sql, sth.orderArgs(args)...)
+	}
+	Started := time.Now()
+	var Res *sql.Row
+	err := sth.withRetry(ctx, false, func() error {
+		Run := func(stmt *sql.Stmt) error {
+			Res = stmt.QueryRowContext(ctx, sth.orderArgs(args)...)
+			return Res.Err()
 		}
-	default:
-		return "err_unknown_db"
+		if Handled, err := sth.onReplica(ctx, Run); Handled {
+			return err
+		}
+		return sth.runPrepared(ctx, Run)
+	})
+	sth.record(Started, 0, err, args)
+	if Res == nil {
+		return sth.dbh.DB.QueryRowContext(ctx, sth.sql, sth.orderArgs(args)...)
+	}
+	return Res
+}
+
+// FetchRow is QueryRowContext with its errors classified, and which, on a
+// statement from Cache, is served from the result cache.
+func (sth *Stmt) FetchRow(ctx context.Context, args ...interface{}) *Row {
+	if err := sth.prepErr(); err != nil {
+		return &Row{err: err}
+	}
+	if sth.cacheable() {
+		if ctx == nil {
+			ctx = sth.dbh.baseContext()
+		}
+		Result, err := sth.cachedResultFor(ctx, args)
+		if err != nil {
+			return &Row{err: err}
+		}
+		return &Row{cached: &CachedRows{e: Result}}
+	}
+	return &Row{row: sth.QueryRowContext(ctx, args...)}
+}
+
+func PrepareOrDie(dbh *DbHandle, sql string) *Stmt {
+	if dbh == nil {
+		log.Fatalf("Prepare for '%s' called with a nil database handle!\n", sql)
 	}
-	return besterror
+	Caw := dbh.Prepare(sql).OrDie()
+	return Caw
 }
 
 func (dbh *DbHandle) DbType() DbType {
@@ -341,6 +551,12 @@ func (dbh *DbHandle) DbType() DbType {
 }
 
 func GetDbType(db *DbHandle) string {
+	if Fake, ok := db.Driver().(*fakeDriver); ok {
+		if Fake.dialect == DbTypePostgres {
+			return "pgsql"
+		}
+		return "mysql"
+	}
 	Type := reflect.ValueOf(db.Driver()).Type().String()
 	switch Type {
 	case "*pq.Driver":
@@ -382,6 +598,8 @@ func FormatMysqlTime(Time time.Time) string {
 	return Time.Format("2006-01-02 15:04:05")
 }
 
+// ApplyTxBlock runs Blocks in one transaction on Db, once; there's no handle,
+// so no retry policy. dbh.ApplyTxBlock is the retried version.
 func ApplyTxBlock(Db *sql.DB, Blocks []TxBlock) error {
 	//log.Printf("Started transaction block with %d entries.\n", len(Blocks))
 	tx, err := Db.Begin()
@@ -406,27 +624,9 @@ func ApplyTxBlock(Db *sql.DB, Blocks []TxBlock) error {
 	return nil
 }
 
+// ParseMysqlTime reads a time in Local; see DbTimeCodec for other zones.
 func ParseMysqlTime(k string) (*time.Time, error) {
-	if k == "" {
-		return nil, nil
-	}
-	localLoc, err := time.LoadLocation("Local")
-	if err != nil {
-		log.Fatalf(`Failed to load location "Local": %s`, err)
-	}
-	var Time time.Time
-	if strings.Index(k, "Z") != -1 {
-		Time, err = time.ParseInLocation("2006-01-02T15:04:05Z", k, localLoc)
-	} else {
-		Time, err = time.ParseInLocation("2006-01-02T15:04:05-07:00", k, localLoc)
-	}
-	if err != nil {
-		return nil, err
-	}
-	localDateTime := Time.Local()
-	//	log.Printf("CAW\nInput: %s\nOutput: %s\n", k, localDateTime.String())
-	//	os.Exit(1)
-	return &localDateTime, nil
+	return localTimeCodec.Parse(k)
 }
 
 func DeferCloseDb(db *sql.DB, label string) {
@@ -0,0 +1,405 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Multi-row inserts and upserts built from sjson rows. Rows are grouped by the set
+of keys they carry, so a row which leaves a column out gets the column's default
+rather than an explicit NULL. Every column is checked against the table before
+anything is sent, ignoring case; the table's columns are read once and kept
+until an insert into it fails. Nested objects and arrays are stored as their
+JSON text.
+
+All the batches of one call go in a single transaction, so they land together
+or not at all; called with the Context() of a WithTx block, they join that
+block's transaction instead.
+*/
+
+const DefaultInsertBatch = 500
+
+// Postgres caps a statement at 65535 bind parameters; MySQL's limit is the same.
+const maxBindParams = 65535
+
+type InsertOptions struct {
+	BatchSize     int      // Rows per INSERT; DefaultInsertBatch if zero
+	Columns       []string // If set, only these columns may be written
+	IgnoreUnknown bool     // Drop columns the table doesn't have, rather than fail
+	UpsertKeys    []string // Conflict target; makes this an upsert
+	UpdateColumns []string // Columns to overwrite on conflict; default is all non-key columns
+}
+
+func dbTypeOfDriver(Db *sql.DB) DbType {
+	if Fake, ok := Db.Driver().(*fakeDriver); ok {
+		return Fake.dialect
+	}
+	switch reflect.ValueOf(Db.Driver()).Type().String() {
+	case "*pq.Driver":
+		return DbTypePostgres
+	case "*mysql.MySQLDriver":
+		return DbTypeMysql
+	}
+	return DbTypeUndef
+}
+
+// quoteIdentFor quotes each part of a dotted name; parts which are already
+// quoted, which may contain dots, are left as they are.
+func quoteIdentFor(Type DbType, Name string) string {
+	Quote := `"`
+	if Type == DbTypeMysql {
+		Quote = "`"
+	}
+	var Parts []string
+	for _, v := range splitIdent(Name, Quote[0]) {
+		if len(v) >= 2 && strings.HasPrefix(v, Quote) && strings.HasSuffix(v, Quote) {
+			Parts = append(Parts, v)
+			continue
+		}
+		Parts = append(Parts, Quote+strings.ReplaceAll(v, Quote, Quote+Quote)+Quote)
+	}
+	return strings.Join(Parts, ".")
+}
+
+// splitIdent splits Name on the dots outside Quote-quoted parts.
+func splitIdent(Name string, Quote byte) []string {
+	var Parts []string
+	var Quoted bool
+	Start := 0
+	for i := 0; i < len(Name); i++ {
+		switch {
+		case Name[i] == Quote:
+			Quoted = !Quoted
+		case Name[i] == '.' && !Quoted:
+			Parts = append(Parts, Name[Start:i])
+			Start = i + 1
+		}
+	}
+	return append(Parts, Name[Start:])
+}
+
+func (dbh *DbHandle) QuoteIdent(Name string) string {
+	return quoteIdentFor(dbh.dbtype, Name)
+}
+
+func placeholderFor(Type DbType, n int) string {
+	if Type == DbTypePostgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// bindPlaceholders numbers each ? in Query for dialects which want $n.
+func bindPlaceholders(Type DbType, Query string) string {
+	if Type != DbTypePostgres {
+		return Query
+	}
+	var Buf strings.Builder
+	n := 0
+	for _, r := range Query {
+		if r == '?' {
+			n++
+			Buf.WriteString(placeholderFor(Type, n))
+			continue
+		}
+		Buf.WriteRune(r)
+	}
+	return Buf.String()
+}
+
+func jsonColumnValue(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}, sjson.JSON, []interface{}, sjson.JSONarray:
+		Bytes, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(Bytes)
+	}
+	return v
+}
+
+type tableColumnsKey struct {
+	Db    *sql.DB
+	Table string
+}
+
+// Column lists, per pool and table; dropped whenever an insert into the table
+// fails, in case it was altered.
+var tableColumnsCache sync.Map
+
+// tableColumns maps the lowercased name of each of the table's columns to the
+// name itself, from DescribeTable where the dialect is known.
+func tableColumns(ctx context.Context, Db *sql.DB, Type DbType, Table string) (map[string]string, error) {
+	Key := tableColumnsKey{Db: Db, Table: Table}
+	if Cached, found := tableColumnsCache.Load(Key); found {
+		return Cached.(map[string]string), nil
+	}
+	var Names []string
+	if Type != DbTypeUndef {
+		Ti, err := describeTable(ctx, Db, Type, Table)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range Ti.Columns {
+			Names = append(Names, v.Name)
+		}
+	} else {
+		Rows, err := Db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE 1=0", quoteIdentFor(Type, Table)))
+		if err != nil {
+			return nil, fmt.Errorf("can't read columns of table '%s': %s", Table, err)
+		}
+		defer Rows.Close()
+		if Names, err = Rows.Columns(); err != nil {
+			return nil, err
+		}
+	}
+	Known := make(map[string]string)
+	for _, v := range Names {
+		Known[strings.ToLower(v)] = v
+	}
+	tableColumnsCache.Store(Key, Known)
+	return Known, nil
+}
+
+func forgetTableColumns(Db *sql.DB, Table string) {
+	tableColumnsCache.Delete(tableColumnsKey{Db: Db, Table: Table})
+}
+
+type insertBuilder struct {
+	Db      *sql.DB
+	Type    DbType
+	Table   string
+	Opts    InsertOptions
+	known   map[string]string // Lowercased name to column name
+	allowed map[string]string // The subset which may be written
+}
+
+// column gives the table's name for a row key or option, matched regardless of
+// case since Postgres folds unquoted names; "" if it isn't writable.
+func (ib *insertBuilder) column(Key string) string {
+	return ib.allowed[strings.ToLower(Key)]
+}
+
+func (ib *insertBuilder) columnsOf(Row sjson.JSON) ([]string, error) {
+	var Cols, Unknown []string
+	for k := range Row {
+		if ib.column(k) == "" {
+			Unknown = append(Unknown, k)
+			continue
+		}
+		Cols = append(Cols, k)
+	}
+	sort.Strings(Cols)
+	if len(Unknown) > 0 {
+		sort.Strings(Unknown)
+		if !ib.Opts.IgnoreUnknown {
+			return nil, fmt.Errorf("columns %v aren't writable in table '%s'", Unknown, ib.Table)
+		}
+		log.Warnf("Dropping columns %v not writable in table '%s'\n", Unknown, ib.Table)
+	}
+	if len(Cols) == 0 {
+		return nil, fmt.Errorf("row has no writable columns for table '%s'", ib.Table)
+	}
+	return Cols, nil
+}
+
+func (ib *insertBuilder) upsertClause(Cols []string) string {
+	if len(ib.Opts.UpsertKeys) == 0 {
+		return ""
+	}
+	IsKey := make(map[string]bool)
+	for _, v := range ib.Opts.UpsertKeys {
+		IsKey[ib.known[strings.ToLower(v)]] = true
+	}
+	var Update []string
+	for _, v := range ib.Opts.UpdateColumns {
+		Update = append(Update, ib.column(v))
+	}
+	if ib.Opts.UpdateColumns == nil {
+		for _, v := range Cols {
+			if !IsKey[ib.column(v)] {
+				Update = append(Update, ib.column(v))
+			}
+		}
+	}
+	var Sets []string
+	switch ib.Type {
+	case DbTypePostgres:
+		var Keys []string
+		for _, v := range ib.Opts.UpsertKeys {
+			Keys = append(Keys, quoteIdentFor(ib.Type, ib.known[strings.ToLower(v)]))
+		}
+		for _, v := range Update {
+			Q := quoteIdentFor(ib.Type, v)
+			Sets = append(Sets, fmt.Sprintf("%s=EXCLUDED.%s", Q, Q))
+		}
+		if len(Sets) == 0 {
+			return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(Keys, ","))
+		}
+		return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(Keys, ","), strings.Join(Sets, ","))
+	default:
+		for _, v := range Update {
+			Q := quoteIdentFor(ib.Type, v)
+			Sets = append(Sets, fmt.Sprintf("%s=VALUES(%s)", Q, Q))
+		}
+		if len(Sets) == 0 {
+			// MySQL has no DO NOTHING; a self-assignment is the idiom.
+			Q := quoteIdentFor(ib.Type, ib.known[strings.ToLower(ib.Opts.UpsertKeys[0])])
+			Sets = append(Sets, fmt.Sprintf("%s=%s", Q, Q))
+		}
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(Sets, ",")
+	}
+}
+
+func (ib *insertBuilder) statement(Cols []string, Rows []sjson.JSON) (string, []interface{}) {
+	var Quoted, Tuples []string
+	var Args []interface{}
+	for _, v := range Cols {
+		Quoted = append(Quoted, quoteIdentFor(ib.Type, ib.column(v)))
+	}
+	for _, Row := range Rows {
+		var Marks []string
+		for _, c := range Cols {
+			Args = append(Args, jsonColumnValue(Row[c]))
+			Marks = append(Marks, placeholderFor(ib.Type, len(Args)))
+		}
+		Tuples = append(Tuples, "("+strings.Join(Marks, ",")+")")
+	}
+	Query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s%s", quoteIdentFor(ib.Type, ib.Table),
+		strings.Join(Quoted, ","), strings.Join(Tuples, ","), ib.upsertClause(Cols))
+	return Query, Args
+}
+
+func (ib *insertBuilder) run(ctx context.Context, dbh *DbHandle, Rows sjson.JSONarray) (Total int64, err error) {
+	if ctx == nil && dbh != nil {
+		ctx = dbh.baseContext()
+	} else if ctx == nil {
+		ctx = context.Background()
+	}
+	Known, err := tableColumns(ctx, ib.Db, ib.Type, ib.Table)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			forgetTableColumns(ib.Db, ib.Table)
+		}
+	}()
+	ib.known, ib.allowed = Known, Known
+	if ib.Opts.Columns != nil {
+		ib.allowed = make(map[string]string)
+		for _, v := range ib.Opts.Columns {
+			if Name := Known[strings.ToLower(v)]; Name != "" {
+				ib.allowed[strings.ToLower(v)] = Name
+			}
+		}
+	}
+	for _, v := range ib.Opts.UpsertKeys {
+		if Known[strings.ToLower(v)] == "" {
+			return 0, fmt.Errorf("upsert key '%s' isn't a column of table '%s'", v, ib.Table)
+		}
+	}
+	for _, v := range ib.Opts.UpdateColumns {
+		if ib.column(v) == "" {
+			return 0, fmt.Errorf("update column '%s' isn't writable in table '%s'", v, ib.Table)
+		}
+	}
+	// Group rows by column set, keeping first-seen order.
+	var Order []string
+	Groups := make(map[string][]sjson.JSON)
+	GroupCols := make(map[string][]string)
+	for k, Row := range Rows {
+		Cols, err := ib.columnsOf(Row)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %s", k, err)
+		}
+		Sig := strings.Join(Cols, "\x00")
+		if _, found := Groups[Sig]; !found {
+			Order = append(Order, Sig)
+			GroupCols[Sig] = Cols
+		}
+		Groups[Sig] = append(Groups[Sig], Row)
+	}
+	Send := func(Tx *sql.Tx) (int64, error) {
+		var Sent int64
+		for _, Sig := range Order {
+			Cols, Group := GroupCols[Sig], Groups[Sig]
+			Batch := ib.Opts.BatchSize
+			if Batch <= 0 {
+				Batch = DefaultInsertBatch
+			}
+			if Batch*len(Cols) > maxBindParams {
+				Batch = maxBindParams / len(Cols)
+			}
+			for Start := 0; Start < len(Group); Start += Batch {
+				End := Start + Batch
+				if End > len(Group) {
+					End = len(Group)
+				}
+				Query, Args := ib.statement(Cols, Group[Start:End])
+				Res, err := Tx.ExecContext(ctx, Query, Args...)
+				if err != nil {
+					return 0, fmt.Errorf("batch of rows %d-%d (columns %v) into '%s' failed: %w",
+						Start, End-1, Cols, ib.Table, dbErrorOrNil(err))
+				}
+				Affected, _ := Res.RowsAffected()
+				Sent += Affected
+			}
+		}
+		return Sent, nil
+	}
+	// Inside a WithTx block the batches join its transaction.
+	if dbh != nil {
+		if Outer := TxFromContext(ctx); Outer != nil && Outer.dbh == dbh {
+			return Send(Outer.Tx)
+		}
+	}
+	Exec := func() error {
+		Tx, err := ib.Db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer Tx.Rollback()
+		if Total, err = Send(Tx); err != nil {
+			return err
+		}
+		return Tx.Commit()
+	}
+	if dbh != nil {
+		err = dbh.withRetry(ctx, "insert into "+ib.Table, true, Exec)
+	} else {
+		err = Exec()
+	}
+	if err != nil {
+		return 0, dbErrorOrNil(err)
+	}
+	return Total, nil
+}
+
+// InsertJsonRows writes Rows to Table in multi-row batches, returning the total
+// rows affected. With Opts.UpsertKeys set, conflicting rows are updated instead.
+func (dbh *DbHandle) InsertJsonRows(ctx context.Context, Table string, Rows sjson.JSONarray, Opts *InsertOptions) (int64, error) {
+	ib := &insertBuilder{Db: dbh.DB, Type: dbh.dbtype, Table: Table}
+	if Opts != nil {
+		ib.Opts = *Opts
+	}
+	return ib.run(ctx, dbh, Rows)
+}
+
+func (dbh *DbHandle) UpsertJsonRows(ctx context.Context, Table string, Rows sjson.JSONarray, Keys []string, UpdateColumns ...string) (int64, error) {
+	return dbh.InsertJsonRows(ctx, Table, Rows, &InsertOptions{UpsertKeys: Keys, UpdateColumns: UpdateColumns})
+}
+
+func (dbh *DbHandle) InsertJsonRow(Table string, Data *sjson.JSON) error {
+	_, err := dbh.InsertJsonRows(nil, Table, sjson.JSONarray{*Data}, nil)
+	return err
+}
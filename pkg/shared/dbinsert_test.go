@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"testing"
+)
+
+func TestQuoteIdentFor(t *testing.T) {
+	for _, c := range []struct {
+		Type DbType
+		Name string
+		Want string
+	}{
+		{DbTypePostgres, "markets", `"markets"`},
+		{DbTypePostgres, "public.markets", `"public"."markets"`},
+		{DbTypePostgres, `"public"."markets"`, `"public"."markets"`},
+		{DbTypePostgres, `"my.schema".markets`, `"my.schema"."markets"`},
+		{DbTypePostgres, `odd"name`, `"odd""name"`},
+		{DbTypeMysql, "db.markets", "`db`.`markets`"},
+		{DbTypeMysql, "`db`.markets", "`db`.`markets`"},
+	} {
+		if Got := quoteIdentFor(c.Type, c.Name); Got != c.Want {
+			t.Errorf("%d '%s' quoted as %s, want %s", c.Type, c.Name, Got, c.Want)
+		}
+	}
+}
+
+func TestInsertJsonRowsAtomic(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypeMysql)
+	Fake.On(`information_schema\.columns`).Return([]string{"column_name", "column_type", "nullable", "column_default"},
+		[]interface{}{"name", "varchar(64)", false, nil})
+	Fake.On(`^INSERT INTO`).Affected(2).Once()
+	Fake.On(`^INSERT INTO`).Fail(FakeError(DbTypeMysql, DbErrSyntax, ""))
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	Rows := sjson.JSONarray{{"name": "btc-usd"}, {"name": "eth-usd"}, {"name": "sol-usd"}}
+	Total, err := dbh.InsertJsonRows(nil, "markets", Rows, &InsertOptions{BatchSize: 2})
+	if err == nil || Total != 0 {
+		t.Errorf("a failed second batch gave %d, %v", Total, err)
+	}
+	if len(Fake.CallsMatching(`^INSERT INTO`)) != 2 {
+		t.Errorf("calls were %+v", Fake.Calls())
+	}
+	if len(Fake.CallsMatching(`^ROLLBACK`)) != 1 || len(Fake.CallsMatching(`^COMMIT`)) != 0 {
+		t.Errorf("the first batch wasn't rolled back: %+v", Fake.Calls())
+	}
+}
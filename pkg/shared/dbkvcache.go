@@ -0,0 +1,191 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"sync"
+	"time"
+)
+
+/*
+Key-value cache kept in a table (see KvCacheTableSql), so every host sharing
+the database shares the cache. Values are JSON objects; each has its own expiry,
+and an expired entry reads as a miss until Sweep or StartSweeper deletes it.
+
+GetOrCompute only runs one computation per key at a time within a process. With
+LockCompute set it also holds a database lock on the key while computing, so a
+miss on several hosts at once costs one computation rather than one per host.
+*/
+
+const (
+	DefaultKvCacheTable = "db_kvcache"
+	DefaultKvCacheTTL   = time.Hour
+)
+
+// KvCacheTableSql returns the statement creating a cache table.
+func KvCacheTableSql(Table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (cache_key VARCHAR(191) NOT NULL PRIMARY KEY, value TEXT NOT NULL, expires TIMESTAMP NOT NULL)", Table)
+}
+
+type KvCache struct {
+	dbh         *DbHandle
+	Table       string
+	DefaultTTL  time.Duration // For Set and GetOrCompute with a zero TTL
+	LockCompute bool
+	flightLock  sync.Mutex
+	flights     map[string]*kvFlight
+}
+
+type kvFlight struct {
+	done  chan struct{}
+	value sjson.JSON
+	err   error
+}
+
+func (dbh *DbHandle) KvCache(Table string) *KvCache {
+	if Table == "" {
+		Table = DefaultKvCacheTable
+	}
+	return &KvCache{
+		dbh:        dbh,
+		Table:      Table,
+		DefaultTTL: DefaultKvCacheTTL,
+		flights:    make(map[string]*kvFlight),
+	}
+}
+
+func (c *KvCache) sql(Query string) string {
+	return bindPlaceholders(c.dbh.dbtype, fmt.Sprintf(Query, c.Table))
+}
+
+// Get returns the value stored under Key, or false if there's none or it has
+// expired.
+func (c *KvCache) Get(ctx context.Context, Key string) (sjson.JSON, bool, error) {
+	ctx, cancel := c.dbh.statementContext(ctx)
+	defer cancel()
+	var Value sjson.JSON
+	err := c.dbh.DB.QueryRowContext(ctx, c.sql("SELECT value FROM %s WHERE cache_key=? AND expires>?"),
+		Key, time.Now().UTC()).Scan(&Value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cache get '%s' from %s: %w", Key, c.Table, dbErrorOrNil(err))
+	}
+	return Value, true, nil
+}
+
+func (c *KvCache) Set(ctx context.Context, Key string, Value sjson.JSON, TTL time.Duration) error {
+	if TTL <= 0 {
+		TTL = c.DefaultTTL
+	}
+	Query := "INSERT INTO %s (cache_key, value, expires) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value=VALUES(value), expires=VALUES(expires)"
+	if c.dbh.dbtype == DbTypePostgres {
+		Query = "INSERT INTO %s (cache_key, value, expires) VALUES (?, ?, ?) ON CONFLICT (cache_key) DO UPDATE SET value=EXCLUDED.value, expires=EXCLUDED.expires"
+	}
+	if Value == nil {
+		Value = sjson.NewJson()
+	}
+	ctx, cancel := c.dbh.statementContext(ctx)
+	defer cancel()
+	_, err := c.dbh.DB.ExecContext(ctx, c.sql(Query), Key, jsonColumnValue(Value), time.Now().UTC().Add(TTL))
+	if err != nil {
+		return fmt.Errorf("cache set '%s' in %s: %w", Key, c.Table, dbErrorOrNil(err))
+	}
+	return nil
+}
+
+func (c *KvCache) Delete(ctx context.Context, Key string) error {
+	ctx, cancel := c.dbh.statementContext(ctx)
+	defer cancel()
+	_, err := c.dbh.DB.ExecContext(ctx, c.sql("DELETE FROM %s WHERE cache_key=?"), Key)
+	return dbErrorOrNil(err)
+}
+
+// GetOrCompute returns the cached value for Key, or else stores and returns
+// what Compute makes of it. Errors from Compute are returned and not cached.
+func (c *KvCache) GetOrCompute(ctx context.Context, Key string, TTL time.Duration,
+	Compute func(context.Context) (sjson.JSON, error)) (sjson.JSON, error) {
+	if ctx == nil {
+		ctx = c.dbh.baseContext()
+	}
+	Value, found, err := c.Get(ctx, Key)
+	if err != nil || found {
+		return Value, err
+	}
+	c.flightLock.Lock()
+	if f, busy := c.flights[Key]; busy {
+		c.flightLock.Unlock()
+		select {
+		case <-f.done:
+			return f.value, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &kvFlight{done: make(chan struct{})}
+	c.flights[Key] = f
+	c.flightLock.Unlock()
+	f.value, f.err = c.compute(ctx, Key, TTL, Compute)
+	c.flightLock.Lock()
+	delete(c.flights, Key)
+	c.flightLock.Unlock()
+	close(f.done)
+	return f.value, f.err
+}
+
+func (c *KvCache) compute(ctx context.Context, Key string, TTL time.Duration,
+	Compute func(context.Context) (sjson.JSON, error)) (sjson.JSON, error) {
+	if c.LockCompute {
+		Lock, err := c.dbh.AcquireLock(ctx, "kvcache:"+c.Table+":"+Key)
+		if err != nil {
+			return nil, err
+		}
+		defer Lock.Release()
+		// Whoever held it before us has probably filled it in.
+		Value, found, err := c.Get(ctx, Key)
+		if err != nil || found {
+			return Value, err
+		}
+	}
+	Value, err := Compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Set(ctx, Key, Value, TTL); err != nil {
+		log.Errorf("Computed '%s' but couldn't cache it: %s\n", Key, err)
+	}
+	return Value, nil
+}
+
+// Sweep deletes expired entries and returns how many there were.
+func (c *KvCache) Sweep(ctx context.Context) (int64, error) {
+	ctx, cancel := c.dbh.statementContext(ctx)
+	defer cancel()
+	Res, err := c.dbh.DB.ExecContext(ctx, c.sql("DELETE FROM %s WHERE expires<=?"), time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("sweeping %s: %w", c.Table, dbErrorOrNil(err))
+	}
+	return Res.RowsAffected()
+}
+
+// StartSweeper runs Sweep every Interval until ctx is cancelled.
+func (c *KvCache) StartSweeper(ctx context.Context, Interval time.Duration) {
+	go func() {
+		Ticker := time.NewTicker(Interval)
+		defer Ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-Ticker.C:
+				Swept, err := c.Sweep(ctx)
+				if !log.ErrorIff(err, "sweeping cache %s", c.Table) && Swept > 0 {
+					log.Debugf("Swept %d expired entries from %s\n", Swept, c.Table)
+				}
+			}
+		}
+	}()
+}
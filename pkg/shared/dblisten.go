@@ -0,0 +1,172 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+/*
+Postgres LISTEN/NOTIFY. Listen opens a dedicated connection (outside the pool)
+through lib/pq's Listener, which reconnects by itself with backoff and re-issues
+the LISTENs. Notifications sent while it was disconnected are lost, so after a
+reconnect a notification with Reconnected set is delivered; whoever consumes
+them should re-read whatever state they were tracking. The same goes when
+credential rotation moves the listener to a new connection.
+*/
+
+const (
+	listenMinReconnect = time.Second
+	listenMaxReconnect = time.Minute
+	listenPingInterval = 90 * time.Second
+)
+
+type DbNotification struct {
+	Channel     string
+	Payload     string
+	BePid       int  // Backend pid of the sender
+	Reconnected bool // Not a notification; the listener reconnected and may have missed some
+}
+
+type DbListener struct {
+	C        <-chan *DbNotification
+	dbh      *DbHandle
+	listener *pq.Listener
+	channels map[string]bool
+	lock     sync.Mutex
+	out      chan *DbNotification
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// Listen subscribes to the given channels on a Postgres handle.
+func (dbh *DbHandle) Listen(Channels ...string) (*DbListener, error) {
+	if dbh.dbtype != DbTypePostgres || dbh.fake {
+		return nil, fmt.Errorf("LISTEN needs a Postgres connection; %s isn't one", dbh.Identifier())
+	}
+	Out := make(chan *DbNotification, 64)
+	l := &DbListener{C: Out, dbh: dbh, out: Out, stop: make(chan struct{}), channels: make(map[string]bool)}
+	l.listener = dbh.newPqListener()
+	for _, v := range Channels {
+		if err := l.Listen(v); err != nil {
+			l.listener.Close()
+			return nil, err
+		}
+	}
+	dbh.rotation.addListener(l)
+	go l.relay()
+	return l, nil
+}
+
+func (dbh *DbHandle) newPqListener() *pq.Listener {
+	return pq.NewListener(dbh.pgDsn(dbh.Host), listenMinReconnect, listenMaxReconnect,
+		func(Event pq.ListenerEventType, err error) {
+			switch Event {
+			case pq.ListenerEventDisconnected:
+				log.Warnf("Listener on %s disconnected: %s\n", dbh.Identifier(), err)
+			case pq.ListenerEventReconnected:
+				log.Infof("Listener on %s reconnected.\n", dbh.Identifier())
+			case pq.ListenerEventConnectionAttemptFailed:
+				log.Debugf("Listener on %s failed to connect: %s\n", dbh.Identifier(), err)
+			}
+		})
+}
+
+func (l *DbListener) Listen(Channel string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.listener.Listen(Channel)
+	if err != nil && err != pq.ErrChannelAlreadyOpen {
+		return fmt.Errorf("LISTEN %s on %s: %w", Channel, l.dbh.Identifier(), err)
+	}
+	l.channels[Channel] = true
+	return nil
+}
+
+func (l *DbListener) Unlisten(Channel string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.channels, Channel)
+	return l.listener.Unlisten(Channel)
+}
+
+func (l *DbListener) current() *pq.Listener {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.listener
+}
+
+// reconnect moves the listener to a connection made with the handle's current
+// credentials, listening there before the old connection is dropped.
+func (l *DbListener) reconnect() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	New := l.dbh.newPqListener()
+	for v := range l.channels {
+		if err := New.Listen(v); err != nil && err != pq.ErrChannelAlreadyOpen {
+			New.Close()
+			return fmt.Errorf("LISTEN %s on %s: %w", v, l.dbh.Identifier(), err)
+		}
+	}
+	Old := l.listener
+	l.listener = New
+	// The relay sees Old's channel close, and reports a reconnect.
+	Old.Close()
+	return nil
+}
+
+func (l *DbListener) relay() {
+	defer close(l.out)
+	for {
+		Listener := l.current()
+		select {
+		case <-l.stop:
+			return
+		case n, ok := <-Listener.Notify:
+			if !ok {
+				select {
+				case <-l.stop:
+					return
+				default:
+				}
+			}
+			Note := &DbNotification{Reconnected: true}
+			// pq sends a nil after reconnecting.
+			if n != nil {
+				Note = &DbNotification{Channel: n.Channel, Payload: n.Extra, BePid: n.BePid}
+			}
+			select {
+			case l.out <- Note:
+			case <-l.stop:
+				return
+			}
+		case <-time.After(listenPingInterval):
+			// A quiet connection may be dead without us knowing; poke it.
+			go Listener.Ping()
+		}
+	}
+}
+
+// Close stops listening; C is closed once the relay exits.
+func (l *DbListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		l.dbh.rotation.removeListener(l)
+		close(l.stop)
+		err = l.current().Close()
+	})
+	return err
+}
+
+// Notify sends Payload to everyone listening on Channel.
+func (dbh *DbHandle) Notify(ctx context.Context, Channel string, Payload string) error {
+	if dbh.dbtype != DbTypePostgres {
+		return fmt.Errorf("NOTIFY needs a Postgres connection; %s isn't one", dbh.Identifier())
+	}
+	ctx, cancel := dbh.statementContext(ctx)
+	defer cancel()
+	_, err := dbh.DB.ExecContext(ctx, "SELECT pg_notify($1, $2)", Channel, Payload)
+	return dbErrorOrNil(err)
+}
@@ -0,0 +1,382 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Cross-host locks. Where ExitIfPidActive stops a second copy on the same box,
+these stop one anywhere that shares the database.
+
+Postgres uses pg_advisory_lock on a key hashed from the name, MySQL uses
+GET_LOCK. Both are tied to a database session, so a held lock keeps a connection
+out of the pool until Release, and is freed by the server if that session dies.
+Other dialects, and handles with LeaseLocks set, get a lease row in DbLeaseTable
+instead, which must be renewed before it expires; see DbLeaseTableSql.
+
+Every held lock is checked every DefaultLockHeartbeat: the session must still be alive
+(and for MySQL, still the holder), or the lease must renew. If not, Lost() is
+closed and Err() says why. RunForLeader builds an election on top of this.
+*/
+
+const (
+	DefaultLockHeartbeat = 10 * time.Second
+	DefaultLeaseTTL      = 30 * time.Second
+	DbLeaseTable         = "db_leases"
+	DbLeaseTableSql      = "CREATE TABLE IF NOT EXISTS db_leases (name VARCHAR(191) NOT NULL PRIMARY KEY, owner VARCHAR(255) NOT NULL, expires TIMESTAMP NOT NULL)"
+)
+
+type DbLock struct {
+	dbh       *DbHandle
+	Name      string
+	Owner     string // Identifies this process in the lease table
+	conn      *sql.Conn
+	lease     bool
+	ttl       time.Duration
+	heartbeat time.Duration
+	stop      chan struct{}
+	lost      chan struct{}
+	lock      sync.Mutex
+	err       error
+	released  bool
+}
+
+var lockOwnerId = func() string {
+	Host, _ := os.Hostname()
+	Suffix, _ := GenerateRandomString(8)
+	return fmt.Sprintf("%s:%d:%s", Host, os.Getpid(), Suffix)
+}()
+
+// pgLockKey hashes a lock name into advisory lock key space.
+func pgLockKey(Name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(Name))
+	return int64(h.Sum64())
+}
+
+// mysqlLockName keeps GET_LOCK under its 64-character limit.
+func mysqlLockName(Name string) string {
+	if len(Name) <= 64 {
+		return Name
+	}
+	return fmt.Sprintf("%.47s:%016x", Name, uint64(pgLockKey(Name)))
+}
+
+// AcquireLock blocks until this process holds the lock called Name, or ctx ends.
+func (dbh *DbHandle) AcquireLock(ctx context.Context, Name string) (*DbLock, error) {
+	return dbh.acquireLock(ctx, Name, true)
+}
+
+// TryLock takes the lock if it's free; the lock is nil if someone else holds it.
+func (dbh *DbHandle) TryLock(ctx context.Context, Name string) (*DbLock, error) {
+	return dbh.acquireLock(ctx, Name, false)
+}
+
+func (dbh *DbHandle) acquireLock(ctx context.Context, Name string, Wait bool) (*DbLock, error) {
+	if ctx == nil {
+		ctx = dbh.baseContext()
+	}
+	l := &DbLock{dbh: dbh, Name: Name, Owner: lockOwnerId, ttl: DefaultLeaseTTL, heartbeat: DefaultLockHeartbeat}
+	var Held bool
+	var err error
+	switch {
+	case !dbh.LeaseLocks && (dbh.dbtype == DbTypePostgres || dbh.dbtype == DbTypeMysql):
+		if l.conn, err = dbh.DB.Conn(ctx); err != nil {
+			return nil, fmt.Errorf("lock '%s' on %s: %w", Name, dbh.Identifier(), dbErrorOrNil(err))
+		}
+		if dbh.dbtype == DbTypePostgres {
+			Held, err = l.acquirePg(ctx, Wait)
+		} else {
+			Held, err = l.acquireMysql(ctx, Wait)
+		}
+		if err != nil || !Held {
+			l.conn.Close()
+		}
+	default:
+		l.lease = true
+		Held, err = l.acquireLease(ctx, Wait)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lock '%s' on %s: %w", Name, dbh.Identifier(), dbErrorOrNil(err))
+	}
+	if !Held {
+		return nil, nil
+	}
+	l.stop = make(chan struct{})
+	l.lost = make(chan struct{})
+	go l.keep()
+	log.Debugf("Acquired lock '%s' on %s\n", Name, dbh.Identifier())
+	return l, nil
+}
+
+func (l *DbLock) acquirePg(ctx context.Context, Wait bool) (bool, error) {
+	if Wait {
+		_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", pgLockKey(l.Name))
+		return err == nil, err
+	}
+	var Held bool
+	err := l.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", pgLockKey(l.Name)).Scan(&Held)
+	return Held, err
+}
+
+func (l *DbLock) acquireMysql(ctx context.Context, Wait bool) (bool, error) {
+	// Wait in short slices, so ctx can interrupt us between them.
+	Timeout := 0
+	if Wait {
+		Timeout = 5
+	}
+	for {
+		var Got sql.NullInt64
+		err := l.conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", mysqlLockName(l.Name), Timeout).Scan(&Got)
+		if err != nil {
+			return false, err
+		}
+		if !Got.Valid {
+			return false, fmt.Errorf("GET_LOCK returned NULL")
+		}
+		if Got.Int64 == 1 {
+			return true, nil
+		}
+		if !Wait {
+			return false, nil
+		}
+		if err = ctx.Err(); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (l *DbLock) leaseSql(Query string) string {
+	return bindPlaceholders(l.dbh.dbtype, Query)
+}
+
+func (l *DbLock) acquireLease(ctx context.Context, Wait bool) (bool, error) {
+	for {
+		Now := time.Now().UTC()
+		_, err := l.dbh.DB.ExecContext(ctx, l.leaseSql("INSERT INTO "+DbLeaseTable+" (name, owner, expires) VALUES (?, ?, ?)"),
+			l.Name, l.Owner, Now.Add(l.ttl))
+		if err == nil {
+			return true, nil
+		}
+		if AsDbError(err).Kind != DbErrDuplicateKey {
+			return false, fmt.Errorf("%w (does %s exist? see DbLeaseTableSql)", err, DbLeaseTable)
+		}
+		// Take it over if the holder let it lapse.
+		Res, err := l.dbh.DB.ExecContext(ctx, l.leaseSql("UPDATE "+DbLeaseTable+" SET owner=?, expires=? WHERE name=? AND expires<?"),
+			l.Owner, Now.Add(l.ttl), l.Name, Now)
+		if err != nil {
+			return false, err
+		}
+		if Affected, _ := Res.RowsAffected(); Affected == 1 {
+			return true, nil
+		}
+		if !Wait {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(l.ttl / 6):
+		}
+	}
+}
+
+// Check confirms the lock is still ours, renewing the lease if it's one.
+func (l *DbLock) Check(ctx context.Context) error {
+	if ctx == nil {
+		ctx = l.dbh.baseContext()
+	}
+	switch {
+	case l.lease:
+		Res, err := l.dbh.DB.ExecContext(ctx, l.leaseSql("UPDATE "+DbLeaseTable+" SET expires=? WHERE name=? AND owner=?"),
+			time.Now().UTC().Add(l.ttl), l.Name, l.Owner)
+		if err != nil {
+			return err
+		}
+		if Affected, _ := Res.RowsAffected(); Affected != 1 {
+			return fmt.Errorf("lease '%s' was taken over", l.Name)
+		}
+	case l.dbh.dbtype == DbTypeMysql:
+		var Mine sql.NullInt64
+		err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", mysqlLockName(l.Name)).Scan(&Mine)
+		if err != nil {
+			return err
+		}
+		if !Mine.Valid || Mine.Int64 != 1 {
+			return fmt.Errorf("lock '%s' is no longer held by our session", l.Name)
+		}
+	default:
+		var One int
+		return l.conn.QueryRowContext(ctx, "SELECT 1").Scan(&One)
+	}
+	return nil
+}
+
+func (l *DbLock) keep() {
+	Ticker := time.NewTicker(l.heartbeat)
+	defer Ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-Ticker.C:
+		}
+		// Not the handle's base context: CancelInFlight mustn't cost us the lock.
+		ctx, cancel := context.WithTimeout(context.Background(), l.heartbeat)
+		err := l.Check(ctx)
+		cancel()
+		if err != nil {
+			log.Warnf("Lost lock '%s' on %s: %s\n", l.Name, l.dbh.Identifier(), err)
+			l.lock.Lock()
+			l.err = err
+			l.lock.Unlock()
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// Lost is closed if the lock is found to be gone.
+func (l *DbLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err says why the lock was lost, or is nil if it wasn't.
+func (l *DbLock) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+func (l *DbLock) Release() error {
+	l.lock.Lock()
+	if l.released {
+		l.lock.Unlock()
+		return nil
+	}
+	l.released = true
+	l.lock.Unlock()
+	close(l.stop)
+	ctx, cancel := l.dbh.statementContext(nil)
+	defer cancel()
+	var err error
+	switch {
+	case l.lease:
+		_, err = l.dbh.DB.ExecContext(ctx, l.leaseSql("DELETE FROM "+DbLeaseTable+" WHERE name=? AND owner=?"), l.Name, l.Owner)
+	case l.dbh.dbtype == DbTypePostgres:
+		_, err = l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", pgLockKey(l.Name))
+	default:
+		_, err = l.conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", mysqlLockName(l.Name))
+	}
+	if l.conn != nil {
+		// Closing the session frees the lock even if the unlock failed.
+		l.conn.Close()
+	}
+	log.Debugf("Released lock '%s' on %s\n", l.Name, l.dbh.Identifier())
+	return err
+}
+
+// ExitIfLockHeld is ExitIfPidActive across hosts: it exits if another process
+// holds Name, and otherwise returns the lock, held until exit or Release.
+func (dbh *DbHandle) ExitIfLockHeld(Name string) *DbLock {
+	Lock, err := dbh.TryLock(nil, Name)
+	if err != nil {
+		log.Fatalf("Couldn't check lock '%s': %s\n", Name, err)
+	}
+	if Lock == nil {
+		log.Infof("Exiting; lock '%s' is held by another process.\n", Name)
+		os.Exit(3)
+	}
+	return Lock
+}
+
+type LeaderOptions struct {
+	Retry     time.Duration             // How often a follower tries for the lock; DefaultLockHeartbeat if zero
+	OnElected func(ctx context.Context) // Run on becoming leader; ctx ends when leadership does
+	OnLost    func(err error)           // Called when leadership is lost or given up
+}
+
+type Leader struct {
+	Name    string
+	dbh     *DbHandle
+	opts    LeaderOptions
+	leading int32
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// RunForLeader keeps trying for the lock called Name until ctx ends or Stop is
+// called. Whoever holds it is the leader, until its heartbeat fails.
+func (dbh *DbHandle) RunForLeader(ctx context.Context, Name string, Opts *LeaderOptions) *Leader {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	Le := &Leader{Name: Name, dbh: dbh, done: make(chan struct{})}
+	if Opts != nil {
+		Le.opts = *Opts
+	}
+	if Le.opts.Retry <= 0 {
+		Le.opts.Retry = DefaultLockHeartbeat
+	}
+	ctx, Le.cancel = context.WithCancel(ctx)
+	go Le.run(ctx)
+	return Le
+}
+
+func (Le *Leader) IsLeader() bool {
+	return atomic.LoadInt32(&Le.leading) == 1
+}
+
+// Stop gives up leadership, if held, and stops running.
+func (Le *Leader) Stop() {
+	Le.cancel()
+	<-Le.done
+}
+
+func (Le *Leader) run(ctx context.Context) {
+	defer close(Le.done)
+	for {
+		Lock, err := Le.dbh.TryLock(ctx, Le.Name)
+		if err != nil && ctx.Err() == nil {
+			log.Warnf("Leader election '%s': %s\n", Le.Name, err)
+		}
+		if Lock != nil {
+			Le.lead(ctx, Lock)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(Le.opts.Retry):
+		}
+	}
+}
+
+func (Le *Leader) lead(ctx context.Context, Lock *DbLock) {
+	atomic.StoreInt32(&Le.leading, 1)
+	log.Infof("Elected leader for '%s' on %s\n", Le.Name, Le.dbh.Identifier())
+	LeaderCtx, cancel := context.WithCancel(ctx)
+	if Le.opts.OnElected != nil {
+		go Le.opts.OnElected(LeaderCtx)
+	}
+	var err error
+	select {
+	case <-Lock.Lost():
+		err = Lock.Err()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	cancel()
+	atomic.StoreInt32(&Le.leading, 0)
+	Lock.Release()
+	log.Infof("No longer leader for '%s': %s\n", Le.Name, err)
+	if Le.opts.OnLost != nil {
+		Le.opts.OnLost(err)
+	}
+}
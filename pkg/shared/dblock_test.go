@@ -0,0 +1,42 @@
+package shared
+
+import (
+	"testing"
+)
+
+func TestLeaseLock(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	// Someone else's lease is there, but has lapsed.
+	Fake.On(`^INSERT INTO db_leases`).Fail(FakeError(DbTypePostgres, DbErrDuplicateKey, ""))
+	Fake.On(`^UPDATE db_leases SET owner=`).Affected(1)
+	Fake.On(`^UPDATE db_leases SET expires=`).Affected(1)
+	Fake.On(`^DELETE FROM db_leases`).Affected(1)
+	dbh := Fake.Handle()
+	defer dbh.Close()
+	dbh.LeaseLocks = true
+
+	Lock, err := dbh.TryLock(nil, "central")
+	if err != nil || Lock == nil {
+		t.Fatalf("TryLock gave %v, %v", Lock, err)
+	}
+	if err = Lock.Check(nil); err != nil {
+		t.Errorf("Check on a renewed lease: %s", err)
+	}
+	if err = Lock.Release(); err != nil {
+		t.Errorf("Release: %s", err)
+	}
+	Calls := Fake.CallsMatching(`^DELETE FROM db_leases`)
+	if len(Calls) != 1 || Calls[0].Args[0] != "central" || Calls[0].Args[1] != Lock.Owner {
+		t.Errorf("Release sent %+v", Calls)
+	}
+	if Calls := Fake.CallsMatching(`pg_advisory`); len(Calls) != 0 {
+		t.Errorf("a lease lock used advisory locks: %+v", Calls)
+	}
+
+	Fake.Reset()
+	Fake.On(`^INSERT INTO db_leases`).Fail(FakeError(DbTypePostgres, DbErrDuplicateKey, ""))
+	Fake.On(`^UPDATE db_leases SET owner=`).Affected(0)
+	if Lock, err = dbh.TryLock(nil, "central"); err != nil || Lock != nil {
+		t.Errorf("TryLock on a live lease gave %v, %v", Lock, err)
+	}
+}
@@ -0,0 +1,243 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Background health monitor. Once started, a handle pings itself every Interval
+until StopMonitor; CancelInFlight doesn't touch it. When a ping fails the
+handle is marked down and pinged again with a jittered backoff (capped at
+MaxBackoff). database/sql redials by itself, so the same pool carries on once
+the server is back; cached and registered statements are prepared again then,
+in case it restarted. A refused login gets the credentials re-read instead.
+Every up/down change is timestamped and kept, and each down-to-up one counts as
+a reconnect.
+
+While up, each good ping checks in with Opts.Sentry, so a sentry watching the
+database trips by itself if the monitor can't reach it. Once the database has
+been down for AlertAfter, Opts.Chat gets a message on its error channel, and
+another when it comes back.
+
+The ini can start a monitor with monitor=<interval> and monitoralert=<duration>.
+*/
+
+const (
+	DefaultMonitorInterval   = 15 * time.Second
+	DefaultMonitorBackoff    = 2 * time.Minute
+	DefaultMonitorAlertAfter = time.Minute
+	dbTransitionsKept        = 50
+)
+
+// HealthCheckin is satisfied by *sentry.Sentry.
+type HealthCheckin interface {
+	Checkin(format string, args ...interface{})
+}
+
+type DbMonitorOptions struct {
+	Interval   time.Duration // Between pings while up; DefaultMonitorInterval if zero
+	MaxBackoff time.Duration // Longest wait between reconnects while down
+	AlertAfter time.Duration // How long down before alerting Chat
+	Sentry     HealthCheckin
+	Chat       *ChatHandle
+	OnChange   func(DbTransition)
+}
+
+type DbTransition struct {
+	Up       bool
+	At       time.Time
+	Err      error         // Why it went down
+	Downtime time.Duration // How long it was down, on coming back up
+}
+
+type DbHealth struct {
+	Monitored   bool
+	Up          bool
+	Since       time.Time // Of the last transition
+	LastCheck   time.Time
+	LastErr     string
+	Reconnects  int
+	Transitions []DbTransition
+}
+
+type dbMonitor struct {
+	opts   DbMonitorOptions
+	cancel context.CancelFunc
+	done   chan struct{}
+	lock   sync.Mutex
+	health DbHealth
+}
+
+func (dbh *DbHandle) StartMonitor(Opts *DbMonitorOptions) error {
+	if dbh.failed != nil {
+		return fmt.Errorf("won't monitor %s; it failed setup: %s", dbh.Identifier(), dbh.failed)
+	}
+	dbh.StopMonitor()
+	m := &dbMonitor{done: make(chan struct{})}
+	if Opts != nil {
+		m.opts = *Opts
+	}
+	if m.opts.Interval <= 0 {
+		m.opts.Interval = DefaultMonitorInterval
+	}
+	if m.opts.MaxBackoff <= 0 {
+		m.opts.MaxBackoff = DefaultMonitorBackoff
+	}
+	if m.opts.AlertAfter <= 0 {
+		m.opts.AlertAfter = DefaultMonitorAlertAfter
+	}
+	m.health = DbHealth{Monitored: true, Up: true, Since: time.Now()}
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(context.Background())
+	dbh.monitorLock.Lock()
+	dbh.monitor = m
+	dbh.monitorLock.Unlock()
+	go dbh.runMonitor(ctx, m)
+	log.Debugf("Started health monitor on %s every %s\n", dbh.Identifier(), m.opts.Interval)
+	return nil
+}
+
+func (dbh *DbHandle) StopMonitor() {
+	dbh.monitorLock.Lock()
+	m := dbh.monitor
+	dbh.monitor = nil
+	dbh.monitorLock.Unlock()
+	if m != nil {
+		m.cancel()
+		<-m.done
+	}
+}
+
+// Health reports what the monitor last saw; Monitored is false if there's no
+// monitor running.
+func (dbh *DbHandle) Health() DbHealth {
+	dbh.monitorLock.Lock()
+	m := dbh.monitor
+	dbh.monitorLock.Unlock()
+	if m == nil {
+		return DbHealth{}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	Health := m.health
+	Health.Transitions = append([]DbTransition{}, m.health.Transitions...)
+	return Health
+}
+
+func (m *dbMonitor) transition(Up bool, err error) DbTransition {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	Now := time.Now()
+	T := DbTransition{Up: Up, At: Now, Err: err}
+	if Up {
+		T.Downtime = Now.Sub(m.health.Since)
+		m.health.Reconnects++
+	}
+	m.health.Up = Up
+	m.health.Since = Now
+	m.health.Transitions = append(m.health.Transitions, T)
+	if len(m.health.Transitions) > dbTransitionsKept {
+		m.health.Transitions = m.health.Transitions[len(m.health.Transitions)-dbTransitionsKept:]
+	}
+	return T
+}
+
+func (m *dbMonitor) checked(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.health.LastCheck = time.Now()
+	m.health.LastErr = ""
+	if err != nil {
+		m.health.LastErr = err.Error()
+	}
+}
+
+func (dbh *DbHandle) monitorPing(ctx context.Context, m *dbMonitor) error {
+	ctx, cancel := context.WithTimeout(ctx, m.opts.Interval)
+	defer cancel()
+	err := dbh.DB.PingContext(ctx)
+	m.checked(err)
+	return err
+}
+
+func (dbh *DbHandle) monitorReconnect(ctx context.Context, m *dbMonitor) error {
+	err := dbh.monitorPing(ctx, m)
+	if err != nil && dbh.rotateOnAuthFailure(err) {
+		err = dbh.monitorPing(ctx, m)
+	}
+	return err
+}
+
+func (dbh *DbHandle) runMonitor(ctx context.Context, m *dbMonitor) {
+	defer close(m.done)
+	defer func() {
+		dbh.monitorLock.Lock()
+		if dbh.monitor == m {
+			dbh.monitor = nil
+		}
+		dbh.monitorLock.Unlock()
+	}()
+	Policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: m.opts.MaxBackoff}
+	var Alerted bool
+	for Attempt := 0; ; {
+		Wait := m.opts.Interval
+		if Attempt > 0 {
+			Wait = Policy.backoff(Attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(Wait):
+		}
+		var err error
+		if Attempt == 0 {
+			err = dbh.monitorPing(ctx, m)
+		} else {
+			err = dbh.monitorReconnect(ctx, m)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			if Attempt > 0 {
+				// The server may have restarted and forgotten our statements.
+				log.ErrorIff(dbh.RePrepareAll(ctx), "re-preparing statements on %s", dbh.Identifier())
+				T := m.transition(true, nil)
+				log.Infof("Database %s is back up after %s.\n", dbh.Identifier(), T.Downtime.Round(time.Second))
+				if Alerted && m.opts.Chat != nil {
+					log.ErrorIff(m.opts.Chat.SendErrorf("Database %s is back up after %s.",
+						dbh.Identifier(), T.Downtime.Round(time.Second)), "sending db recovery notice")
+				}
+				if m.opts.OnChange != nil {
+					m.opts.OnChange(T)
+				}
+			}
+			Attempt, Alerted = 0, false
+			if m.opts.Sentry != nil {
+				m.opts.Sentry.Checkin("database %s up", dbh.Identifier())
+			}
+			continue
+		}
+		if Attempt == 0 {
+			T := m.transition(false, err)
+			log.Errorf("Database %s is down: %s\n", dbh.Identifier(), err)
+			if m.opts.OnChange != nil {
+				m.opts.OnChange(T)
+			}
+		} else {
+			log.Warnf("Reconnect %d of %s failed: %s\n", Attempt, dbh.Identifier(), err)
+		}
+		Attempt++
+		m.lock.Lock()
+		Downtime := time.Since(m.health.Since)
+		m.lock.Unlock()
+		if !Alerted && m.opts.Chat != nil && Downtime >= m.opts.AlertAfter {
+			Alerted = true
+			log.ErrorIff(m.opts.Chat.SendErrorf("Database %s has been unreachable for %s: %s",
+				dbh.Identifier(), Downtime.Round(time.Second), err), "sending db outage alert")
+		}
+	}
+}
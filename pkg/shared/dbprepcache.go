@@ -0,0 +1,215 @@
+package shared
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+)
+
+/*
+Prepared statement cache. Once it's sized (the ini's prepcache, or
+SetPrepCacheSize; DefaultPrepCacheSize suits most), DbHandle.Prepare hands back
+the same *Stmt for the same SQL text, keeping at most that many and closing the
+least recently used, on the primary and any replicas, when full.
+
+Closing an evicted statement is safe even if someone still holds it: a Stmt
+whose underlying statement is gone (evicted, lost with its connection, or from
+before a reconnect) quietly re-prepares itself and tries once more.
+*/
+
+const DefaultPrepCacheSize = 256
+
+type prepCache struct {
+	lock    sync.Mutex
+	limit   int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newPrepCache(Limit int) *prepCache {
+	return &prepCache{
+		limit:   Limit,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (pc *prepCache) get(sql string) *Stmt {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	Elem, found := pc.entries[sql]
+	if !found {
+		return nil
+	}
+	pc.order.MoveToFront(Elem)
+	return Elem.Value.(*Stmt)
+}
+
+// put caches sth, unless another goroutine beat us to the same SQL, in which
+// case the winner is returned and sth is closed.
+func (pc *prepCache) put(sth *Stmt) *Stmt {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if Elem, found := pc.entries[sth.sql]; found {
+		sth.Stmt.Close()
+		pc.order.MoveToFront(Elem)
+		return Elem.Value.(*Stmt)
+	}
+	pc.entries[sth.sql] = pc.order.PushFront(sth)
+	for pc.limit > 0 && pc.order.Len() > pc.limit {
+		Oldest := pc.order.Back()
+		Evicted := pc.order.Remove(Oldest).(*Stmt)
+		delete(pc.entries, Evicted.sql)
+		log.Debugf("Evicting prepared statement %s from cache\n", Evicted.Identify())
+		Evicted.current().Close()
+		Evicted.closeReplicaStmts()
+	}
+	return sth
+}
+
+func (pc *prepCache) all() []*Stmt {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	var Stmts []*Stmt
+	for Elem := pc.order.Front(); Elem != nil; Elem = Elem.Next() {
+		Stmts = append(Stmts, Elem.Value.(*Stmt))
+	}
+	return Stmts
+}
+
+func (pc *prepCache) len() int {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.order.Len()
+}
+
+func (dbh *DbHandle) SetPrepCacheSize(Limit int) *DbHandle {
+	if Limit <= 0 {
+		dbh.prepCache = nil
+		return dbh
+	}
+	if dbh.prepCache == nil {
+		dbh.prepCache = newPrepCache(Limit)
+	} else {
+		dbh.prepCache.lock.Lock()
+		dbh.prepCache.limit = Limit
+		dbh.prepCache.lock.Unlock()
+	}
+	return dbh
+}
+
+func (dbh *DbHandle) PrepCacheLen() int {
+	if dbh.prepCache == nil {
+		return 0
+	}
+	return dbh.prepCache.len()
+}
+
+// RePrepareAll re-prepares every cached or registered statement, returning the
+// first failure.
+func (dbh *DbHandle) RePrepareAll(ctx context.Context) error {
+	Stmts := dbh.registeredStmts()
+	if dbh.prepCache != nil {
+		Stmts = append(Stmts, dbh.prepCache.all()...)
+	}
+	var First error
+	Done := make(map[*Stmt]bool)
+	for _, sth := range Stmts {
+		if Done[sth] {
+			continue
+		}
+		Done[sth] = true
+		err := sth.reprepare(ctx, sth.current())
+		if err != nil {
+			log.Errorf("Failed to re-prepare %s: %s\n", sth.Identify(), err)
+			if First == nil {
+				First = err
+			}
+		}
+	}
+	return First
+}
+
+func isStaleStatement(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == mysqlerr.ER_UNKNOWN_STMT_HANDLER {
+		return true
+	}
+	var pgErr *pq.Error
+	if errors.As(err, &pgErr) && pgErr.Code.Name() == "invalid_sql_statement_name" {
+		return true
+	}
+	// database/sql doesn't export these.
+	Msg := err.Error()
+	return strings.Contains(Msg, "statement is closed") || strings.Contains(Msg, "database is closed")
+}
+
+func (sth *Stmt) current() *sql.Stmt {
+	if sth.base != nil {
+		return sth.base.current()
+	}
+	sth.prepLock.RLock()
+	defer sth.prepLock.RUnlock()
+	return sth.Stmt
+}
+
+// prepErr is why the statement failed to prepare, if it did; reprepare clears
+// it, so it's read under the same lock.
+func (sth *Stmt) prepErr() error {
+	if sth.base != nil {
+		return sth.base.prepErr()
+	}
+	sth.prepLock.RLock()
+	defer sth.prepLock.RUnlock()
+	return sth.failure
+}
+
+func (sth *Stmt) reprepare(ctx context.Context, Stale *sql.Stmt) error {
+	if sth.base != nil {
+		return sth.base.reprepare(ctx, Stale)
+	}
+	sth.prepLock.Lock()
+	if sth.Stmt != Stale {
+		sth.prepLock.Unlock()
+		return nil
+	}
+	if ctx == nil {
+		ctx = sth.dbh.baseContext()
+	}
+	Fresh, err := sth.dbh.DB.PrepareContext(ctx, sth.sql)
+	if err != nil {
+		sth.prepLock.Unlock()
+		return err
+	}
+	sth.Stmt = Fresh
+	sth.failure = nil
+	sth.prepLock.Unlock()
+	sth.closeReplicaStmts()
+	// Closed only once nobody can pick it up. Anyone who already had it and
+	// gets "statement is closed" finds Fresh in runPrepared and runs again;
+	// executions already under way are left to finish by sql.Stmt.Close.
+	if Stale != nil {
+		Stale.Close()
+	}
+	return nil
+}
+
+func (sth *Stmt) runPrepared(ctx context.Context, Fn func(*sql.Stmt) error) error {
+	Current := sth.current()
+	err := Fn(Current)
+	if err == nil || sth.tx != nil || !isStaleStatement(err) {
+		return err
+	}
+	log.Infof("Re-preparing %s after: %s\n", sth.Identify(), err)
+	if prepErr := sth.reprepare(ctx, Current); prepErr != nil {
+		log.Errorf("Re-prepare of %s failed: %s\n", sth.Identify(), prepErr)
+		return err
+	}
+	return Fn(sth.current())
+}
@@ -0,0 +1,468 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Durable job queue. Jobs live in one table (see JobTableSql), shared by any
+number of named queues. Dequeue claims the highest-priority job that is due
+with SELECT ... FOR UPDATE SKIP LOCKED (Postgres, or MySQL 8), so workers on
+many hosts never block on or double-claim each other's rows.
+
+A claimed job is RUNNING until its visibility timeout; if the worker dies and
+doesn't Complete, Fail or Extend it by then, the job can be claimed again. A
+failed job goes back to PENDING after a backoff, until it has used MaxAttempts,
+when it's parked as DEAD for someone to look at; Requeue brings it back.
+
+Work runs handlers in a loop, keeping claimed jobs extended while they run,
+and checks in with a sentry after each job or empty poll, so a sentry watching
+the queue trips if the workers stall or lose the database.
+*/
+
+const (
+	DefaultJobTable        = "db_jobs"
+	DefaultJobVisibility   = 5 * time.Minute
+	DefaultJobMaxAttempts  = 5
+	DefaultJobPollInterval = 5 * time.Second
+
+	JobPending = "PENDING"
+	JobRunning = "RUNNING"
+	JobDone    = "DONE"
+	JobDead    = "DEAD"
+)
+
+var ErrJobLost = errors.New("job is no longer ours; its visibility timeout lapsed")
+
+// JobTableSql returns the statements creating a job table in the given
+// dialect; run them one at a time.
+func JobTableSql(Type DbType, Table string) []string {
+	Id, Exists := "id BIGSERIAL PRIMARY KEY", "IF NOT EXISTS "
+	if Type == DbTypeMysql {
+		Id, Exists = "id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY", ""
+	}
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	%s,
+	queue VARCHAR(191) NOT NULL,
+	payload TEXT NOT NULL,
+	priority INT NOT NULL DEFAULT 0,
+	status VARCHAR(16) NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	max_attempts INT NOT NULL,
+	run_at TIMESTAMP NOT NULL,
+	locked_by VARCHAR(255) NULL,
+	locked_until TIMESTAMP NULL,
+	last_error TEXT NULL,
+	created TIMESTAMP NOT NULL,
+	updated TIMESTAMP NOT NULL
+)`, Table, Id),
+		fmt.Sprintf("CREATE INDEX %s%s_claim ON %s (queue, status, priority, run_at)", Exists, Table, Table),
+	}
+}
+
+type JobQueue struct {
+	dbh        *DbHandle
+	Name       string
+	Table      string
+	Owner      string        // Recorded as locked_by on claimed jobs
+	Visibility time.Duration // How long a claim lasts without Extend
+	Backoff    RetryPolicy   // Delay before a failed job is retried; BaseDelay and MaxDelay are used
+}
+
+type EnqueueOptions struct {
+	Priority    int // Higher runs first
+	RunAt       time.Time
+	Delay       time.Duration // From now; ignored if RunAt is set
+	MaxAttempts int
+}
+
+type Job struct {
+	Id          int64
+	Queue       string
+	Payload     sjson.JSON
+	Priority    int
+	Attempts    int // Including the current one
+	MaxAttempts int
+	RunAt       time.Time
+	Created     time.Time
+	LastError   string
+	q           *JobQueue
+}
+
+type JobHandler func(ctx context.Context, j *Job) error
+
+type JobWorkerOptions struct {
+	Concurrency  int
+	PollInterval time.Duration // Wait after finding the queue empty
+	Sentry       HealthCheckin
+}
+
+func (dbh *DbHandle) JobQueue(Name string) *JobQueue {
+	return &JobQueue{
+		dbh:        dbh,
+		Name:       Name,
+		Table:      DefaultJobTable,
+		Owner:      lockOwnerId,
+		Visibility: DefaultJobVisibility,
+		Backoff:    RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: time.Hour},
+	}
+}
+
+// bind fills in the table name and the dialect's placeholders.
+func (q *JobQueue) bind(Query string) string {
+	return bindPlaceholders(q.dbh.dbtype, strings.ReplaceAll(Query, "%T", q.Table))
+}
+
+func (q *JobQueue) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return q.dbh.statementContext(ctx)
+}
+
+func (q *JobQueue) Enqueue(ctx context.Context, Payload sjson.JSON, Opts *EnqueueOptions) (int64, error) {
+	var o EnqueueOptions
+	if Opts != nil {
+		o = *Opts
+	}
+	Now := time.Now().UTC()
+	if o.RunAt.IsZero() {
+		o.RunAt = Now.Add(o.Delay)
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultJobMaxAttempts
+	}
+	if Payload == nil {
+		Payload = sjson.NewJson()
+	}
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Sql := q.bind(`INSERT INTO %T (queue, payload, priority, status, attempts, max_attempts, run_at, created, updated)
+		VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?)`)
+	Args := []interface{}{q.Name, jsonColumnValue(Payload), o.Priority, JobPending, o.MaxAttempts, o.RunAt.UTC(), Now, Now}
+	var Id int64
+	if q.dbh.dbtype == DbTypePostgres {
+		err := q.dbh.DB.QueryRowContext(ctx, Sql+" RETURNING id", Args...).Scan(&Id)
+		if err != nil {
+			return 0, fmt.Errorf("enqueue on %s: %w", q.Name, dbErrorOrNil(err))
+		}
+		return Id, nil
+	}
+	Res, err := q.dbh.DB.ExecContext(ctx, Sql, Args...)
+	if err == nil {
+		Id, err = Res.LastInsertId()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("enqueue on %s: %w", q.Name, dbErrorOrNil(err))
+	}
+	return Id, nil
+}
+
+// Dequeue claims the next due job, or returns nil if there isn't one.
+func (q *JobQueue) Dequeue(ctx context.Context) (*Job, error) {
+	for {
+		j, err := q.claim(ctx)
+		if err != nil || j == nil {
+			return nil, err
+		}
+		// Only a claim that lapsed (its worker died) can get here over the limit.
+		if j.Attempts > j.MaxAttempts {
+			log.Warnf("Job %d on queue %s timed out on every attempt; marking it dead.\n", j.Id, q.Name)
+			if err = j.finish(ctx, JobDead, "visibility timeout lapsed on final attempt", time.Time{}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return j, nil
+	}
+}
+
+func (q *JobQueue) claim(ctx context.Context) (*Job, error) {
+	var j *Job
+	err := q.dbh.WithTx(ctx, nil, func(tx *Tx) error {
+		j = nil
+		Now := time.Now().UTC()
+		Row := tx.QueryRowContext(tx.Context(), q.bind(`SELECT id, payload, priority, attempts, max_attempts, run_at, created, last_error
+			FROM %T WHERE queue=? AND ((status=? AND run_at<=?) OR (status=? AND locked_until<?))
+			ORDER BY priority DESC, run_at, id LIMIT 1 FOR UPDATE SKIP LOCKED`),
+			q.Name, JobPending, Now, JobRunning, Now)
+		Found := &Job{Queue: q.Name, q: q}
+		var LastError sql.NullString
+		err := Row.Scan(&Found.Id, &Found.Payload, &Found.Priority, &Found.Attempts, &Found.MaxAttempts,
+			&Found.RunAt, &Found.Created, &LastError)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		Found.LastError = LastError.String
+		Found.Attempts++
+		_, err = tx.ExecContext(tx.Context(), q.bind(`UPDATE %T SET status=?, attempts=?, locked_by=?, locked_until=?, updated=? WHERE id=?`),
+			JobRunning, Found.Attempts, q.Owner, Now.Add(q.Visibility), Now, Found.Id)
+		if err != nil {
+			return err
+		}
+		j = Found
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dequeue on %s: %w", q.Name, err)
+	}
+	return j, nil
+}
+
+// finish moves a job we hold out of RUNNING.
+func (j *Job) finish(ctx context.Context, Status string, Reason string, RunAt time.Time) error {
+	q := j.q
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Now := time.Now().UTC()
+	if RunAt.IsZero() {
+		RunAt = j.RunAt
+	}
+	Res, err := q.dbh.DB.ExecContext(ctx, q.bind(`UPDATE %T SET status=?, last_error=?, run_at=?, locked_by=NULL, locked_until=NULL, updated=?
+		WHERE id=? AND status=? AND locked_by=?`),
+		Status, sql.NullString{String: Reason, Valid: Reason != ""}, RunAt.UTC(), Now, j.Id, JobRunning, q.Owner)
+	if err != nil {
+		return fmt.Errorf("job %d on %s: %w", j.Id, q.Name, dbErrorOrNil(err))
+	}
+	if Affected, _ := Res.RowsAffected(); Affected != 1 {
+		return fmt.Errorf("job %d on %s: %w", j.Id, q.Name, ErrJobLost)
+	}
+	return nil
+}
+
+func (j *Job) Complete(ctx context.Context) error {
+	return j.finish(ctx, JobDone, "", time.Time{})
+}
+
+// Fail schedules a retry after the queue's backoff, or parks the job as dead
+// if that was its last attempt.
+func (j *Job) Fail(ctx context.Context, Cause error) error {
+	Reason := fmt.Sprintf("%s", Cause)
+	if j.Attempts >= j.MaxAttempts {
+		log.Errorf("Job %d on queue %s failed for good after %d attempts: %s\n", j.Id, j.q.Name, j.Attempts, Reason)
+		return j.finish(ctx, JobDead, Reason, time.Time{})
+	}
+	Delay := j.q.Backoff.backoff(j.Attempts - 1)
+	log.Warnf("Job %d on queue %s failed attempt %d of %d, retrying in %s: %s\n",
+		j.Id, j.q.Name, j.Attempts, j.MaxAttempts, Delay.Round(time.Second), Reason)
+	return j.finish(ctx, JobPending, Reason, time.Now().Add(Delay))
+}
+
+// DeadLetter gives up on the job without using its remaining attempts.
+func (j *Job) DeadLetter(ctx context.Context, Cause error) error {
+	return j.finish(ctx, JobDead, fmt.Sprintf("%s", Cause), time.Time{})
+}
+
+// Extend pushes our claim out to Visibility from now.
+func (j *Job) Extend(ctx context.Context, Visibility time.Duration) error {
+	q := j.q
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Now := time.Now().UTC()
+	Res, err := q.dbh.DB.ExecContext(ctx, q.bind(`UPDATE %T SET locked_until=?, updated=? WHERE id=? AND status=? AND locked_by=?`),
+		Now.Add(Visibility), Now, j.Id, JobRunning, q.Owner)
+	if err != nil {
+		return fmt.Errorf("job %d on %s: %w", j.Id, q.Name, dbErrorOrNil(err))
+	}
+	if Affected, _ := Res.RowsAffected(); Affected != 1 {
+		return fmt.Errorf("job %d on %s: %w", j.Id, q.Name, ErrJobLost)
+	}
+	return nil
+}
+
+// release hands the job back without counting the attempt, for a worker
+// that is shutting down.
+func (j *Job) release(ctx context.Context) error {
+	q := j.q
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	_, err := q.dbh.DB.ExecContext(ctx, q.bind(`UPDATE %T SET status=?, attempts=attempts-1, locked_by=NULL, locked_until=NULL, updated=?
+		WHERE id=? AND status=? AND locked_by=?`),
+		JobPending, time.Now().UTC(), j.Id, JobRunning, q.Owner)
+	return dbErrorOrNil(err)
+}
+
+func (q *JobQueue) DeadLetters(ctx context.Context, Limit int) ([]*Job, error) {
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Rows, err := q.dbh.DB.QueryContext(ctx, q.bind(`SELECT id, payload, priority, attempts, max_attempts, run_at, created, last_error
+		FROM %T WHERE queue=? AND status=? ORDER BY updated DESC LIMIT ?`), q.Name, JobDead, Limit)
+	if err != nil {
+		return nil, dbErrorOrNil(err)
+	}
+	defer Rows.Close()
+	var Jobs []*Job
+	for Rows.Next() {
+		j := &Job{Queue: q.Name, q: q}
+		var LastError sql.NullString
+		err = Rows.Scan(&j.Id, &j.Payload, &j.Priority, &j.Attempts, &j.MaxAttempts, &j.RunAt, &j.Created, &LastError)
+		if err != nil {
+			return nil, err
+		}
+		j.LastError = LastError.String
+		Jobs = append(Jobs, j)
+	}
+	return Jobs, Rows.Err()
+}
+
+// Requeue puts a dead job back with a fresh set of attempts.
+func (q *JobQueue) Requeue(ctx context.Context, Id int64) error {
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Now := time.Now().UTC()
+	Res, err := q.dbh.DB.ExecContext(ctx, q.bind(`UPDATE %T SET status=?, attempts=0, run_at=?, updated=? WHERE id=? AND queue=? AND status=?`),
+		JobPending, Now, Now, Id, q.Name, JobDead)
+	if err != nil {
+		return dbErrorOrNil(err)
+	}
+	if Affected, _ := Res.RowsAffected(); Affected != 1 {
+		return fmt.Errorf("no dead job %d on queue %s", Id, q.Name)
+	}
+	return nil
+}
+
+// Purge deletes jobs which completed more than Age ago.
+func (q *JobQueue) Purge(ctx context.Context, Age time.Duration) (int64, error) {
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Res, err := q.dbh.DB.ExecContext(ctx, q.bind(`DELETE FROM %T WHERE queue=? AND status=? AND updated<?`),
+		q.Name, JobDone, time.Now().UTC().Add(-Age))
+	if err != nil {
+		return 0, dbErrorOrNil(err)
+	}
+	return Res.RowsAffected()
+}
+
+// Counts returns how many jobs the queue has in each status.
+func (q *JobQueue) Counts(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := q.context(ctx)
+	defer cancel()
+	Rows, err := q.dbh.DB.QueryContext(ctx, q.bind(`SELECT status, COUNT(*) FROM %T WHERE queue=? GROUP BY status`), q.Name)
+	if err != nil {
+		return nil, dbErrorOrNil(err)
+	}
+	defer Rows.Close()
+	Counts := make(map[string]int)
+	for Rows.Next() {
+		var (
+			Status string
+			Count  int
+		)
+		if err = Rows.Scan(&Status, &Count); err != nil {
+			return nil, err
+		}
+		Counts[Status] = Count
+	}
+	return Counts, Rows.Err()
+}
+
+// Work runs Handler on jobs until ctx is cancelled, then waits for the jobs in
+// hand to finish. A nil return from Handler completes the job; an error fails it.
+func (q *JobQueue) Work(ctx context.Context, Opts *JobWorkerOptions, Handler JobHandler) {
+	var o JobWorkerOptions
+	if Opts != nil {
+		o = *Opts
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = DefaultJobPollInterval
+	}
+	var Done, Failed int64
+	var Wg sync.WaitGroup
+	for i := 0; i < o.Concurrency; i++ {
+		Wg.Add(1)
+		go func() {
+			defer Wg.Done()
+			for ctx.Err() == nil {
+				j, err := q.Dequeue(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Errorf("Worker on queue %s can't dequeue: %s\n", q.Name, err)
+				}
+				if j != nil {
+					if q.runJob(ctx, j, Handler) {
+						atomic.AddInt64(&Done, 1)
+					} else {
+						atomic.AddInt64(&Failed, 1)
+					}
+				}
+				if err == nil && o.Sentry != nil {
+					o.Sentry.Checkin("queue %s: %d done, %d failed", q.Name, atomic.LoadInt64(&Done), atomic.LoadInt64(&Failed))
+				}
+				if j != nil {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(o.PollInterval):
+				}
+			}
+		}()
+	}
+	Wg.Wait()
+}
+
+// runJob reports whether the handler succeeded.
+func (q *JobQueue) runJob(ctx context.Context, j *Job, Handler JobHandler) bool {
+	JobCtx, cancel := context.WithCancel(ctx)
+	Stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-Stop:
+				return
+			case <-time.After(q.Visibility / 3):
+			}
+			// Not the handle's base context: CancelInFlight mustn't make a job
+			// we're still running look lost.
+			Beat, done := context.WithTimeout(context.Background(), q.Visibility/3)
+			err := j.Extend(Beat, q.Visibility)
+			done()
+			if err != nil {
+				log.Errorf("Lost hold of job %d on queue %s: %s\n", j.Id, q.Name, err)
+				cancel()
+				return
+			}
+		}
+	}()
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Critf("Panic in job %d on queue %s: %v\n%s\n", j.Id, q.Name, r, debug.Stack())
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return Handler(JobCtx, j)
+	}()
+	close(Stop)
+	Lost := JobCtx.Err() != nil && ctx.Err() == nil
+	cancel()
+	if Lost {
+		return false
+	}
+	// Bookkeeping shouldn't fail just because we're shutting down, or because
+	// CancelInFlight was called.
+	Bg := context.Background()
+	switch {
+	case err == nil:
+		err = j.Complete(Bg)
+		log.ErrorIff(err, "completing job %d on queue %s", j.Id, q.Name)
+		return err == nil
+	case ctx.Err() != nil:
+		log.ErrorIff(j.release(Bg), "releasing job %d on queue %s", j.Id, q.Name)
+	default:
+		log.ErrorIff(j.Fail(Bg, err), "failing job %d on queue %s", j.Id, q.Name)
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+/*
+Declarative prepared statements. A program describes its queries as a struct of
+*Stmt fields tagged with their SQL:
+
+	var Q struct {
+		GetUser *shared.Stmt `sql:"SELECT id, name FROM users WHERE id=$1"`
+		AddUser *shared.Stmt `sql:"INSERT INTO users (name) VALUES ($1)" mysql:"INSERT INTO users (name) VALUES (?)"`
+	}
+	err := dbh.PrepareAll(&Q)
+
+A `mysql` or `postgres` tag overrides `sql` on that dialect. Embedded structs
+are walked too. Every field is prepared even if an earlier one fails, so one run
+reports every broken query. Registered statements are re-prepared whenever the
+handle reconnects, whether or not the statement cache holds them.
+*/
+
+type PrepareErrors []error
+
+func (pe PrepareErrors) Error() string {
+	var Lines []string
+	for _, v := range pe {
+		Lines = append(Lines, v.Error())
+	}
+	return fmt.Sprintf("%d statements failed to prepare:\n%s", len(pe), strings.Join(Lines, "\n"))
+}
+
+var stmtPtrType = reflect.TypeOf((*Stmt)(nil))
+
+func (dbh *DbHandle) sqlForTag(Tag reflect.StructTag) string {
+	var Dialect string
+	switch dbh.dbtype {
+	case DbTypeMysql:
+		Dialect = "mysql"
+	case DbTypePostgres:
+		Dialect = "postgres"
+	}
+	if Sql, found := Tag.Lookup(Dialect); found && Dialect != "" {
+		return Sql
+	}
+	return Tag.Get("sql")
+}
+
+func (dbh *DbHandle) prepareFields(ctx context.Context, Value reflect.Value, Prefix string, Errs *PrepareErrors) {
+	Type := Value.Type()
+	for i := 0; i < Type.NumField(); i++ {
+		Field := Type.Field(i)
+		if Field.PkgPath != "" {
+			continue
+		}
+		if Field.Anonymous && Field.Type.Kind() == reflect.Struct {
+			dbh.prepareFields(ctx, Value.Field(i), Prefix, Errs)
+			continue
+		}
+		if Field.Type != stmtPtrType {
+			continue
+		}
+		Sql := dbh.sqlForTag(Field.Tag)
+		if Sql == "" {
+			continue
+		}
+		sth := dbh.PrepareContext(ctx, Sql)
+		Value.Field(i).Set(reflect.ValueOf(sth))
+		dbh.registerStmt(sth)
+		if err := sth.prepErr(); err != nil {
+			*Errs = append(*Errs, fmt.Errorf("%s%s: %w", Prefix, Field.Name, dbErrorOrNil(err)))
+		}
+	}
+}
+
+// PrepareAll prepares every tagged *Stmt field of the struct Queries points to.
+// Failed fields still get a *Stmt (whose Err() says why); the returned error is
+// a PrepareErrors listing all of them.
+func (dbh *DbHandle) PrepareAll(Queries interface{}) error {
+	return dbh.PrepareAllContext(nil, Queries)
+}
+
+func (dbh *DbHandle) PrepareAllContext(ctx context.Context, Queries interface{}) error {
+	Value := reflect.ValueOf(Queries)
+	if Value.Kind() != reflect.Ptr || Value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("PrepareAll needs a pointer to a struct, not %T", Queries)
+	}
+	var Errs PrepareErrors
+	dbh.prepareFields(ctx, Value.Elem(), Value.Elem().Type().Name()+".", &Errs)
+	if len(Errs) > 0 {
+		return Errs
+	}
+	return nil
+}
+
+func (dbh *DbHandle) PrepareAllOrDie(Queries interface{}) {
+	err := dbh.PrepareAll(Queries)
+	if err == nil {
+		return
+	}
+	if Errs, ok := err.(PrepareErrors); ok {
+		for _, v := range Errs {
+			log.Critf("Failed to prepare on %s: %s\n", dbh.Identifier(), v)
+		}
+	} else {
+		log.Critf("%s\n", err)
+	}
+	log.Printf("Exiting due to unprepared statements (see above)\n")
+	os.Exit(1)
+}
+
+func (dbh *DbHandle) registerStmt(sth *Stmt) {
+	dbh.registryLock.Lock()
+	defer dbh.registryLock.Unlock()
+	for _, v := range dbh.registered {
+		if v == sth {
+			return
+		}
+	}
+	dbh.registered = append(dbh.registered, sth)
+}
+
+func (dbh *DbHandle) registeredStmts() []*Stmt {
+	dbh.registryLock.Lock()
+	defer dbh.registryLock.Unlock()
+	return append([]*Stmt{}, dbh.registered...)
+}
@@ -0,0 +1,318 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Read replicas. A db section may list replicas=host1,host2; they share the
+section's dbname, dbuser and dbpass. Routing is explicit: statements from
+FromReplica(), and every statement on a ReadOnly handle, go to a healthy
+replica, picked round-robin. The SQL isn't looked at, since a SELECT can write
+(a data-modifying WITH, nextval(), a function with side effects). Everything
+else stays on the primary, as does any query when no replica is up; FromPrimary()
+pins a statement there even on a ReadOnly handle, for reads which must see the
+caller's own writes. Transactions always use the primary.
+
+Replicas are pinged every ReplicaCheck (the ini's replicacheck, default 10s)
+until CloseReplicas; a replica that loses its connection mid-query is marked
+down on the spot and the query is re-run on the primary.
+*/
+
+const DefaultReplicaCheck = 10 * time.Second
+
+type stmtRoute int
+
+const (
+	routeDefault stmtRoute = 0 // Replica only on a ReadOnly handle
+	routeReplica stmtRoute = 1
+	routePrimary stmtRoute = 2
+)
+
+type dbReplica struct {
+	Host      string
+	DB        *sql.DB
+	connector *dsnConnector
+	healthy   int32
+	lastErr   error
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+type ReplicaStatus struct {
+	Host      string
+	Healthy   bool
+	LastCheck time.Time
+	LastErr   string
+}
+
+func (r *dbReplica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *dbReplica) setHealth(err error) (Changed bool) {
+	r.lock.Lock()
+	r.lastErr = err
+	r.lastCheck = time.Now()
+	r.lock.Unlock()
+	var State int32
+	if err == nil {
+		State = 1
+	}
+	return atomic.SwapInt32(&r.healthy, State) != State
+}
+
+func (dbh *DbHandle) AddReplica(Host string) error {
+	switch dbh.dbtype {
+	case DbTypeMysql, DbTypePostgres:
+	default:
+		return fmt.Errorf("can't add replica '%s' to %s; unknown database type", Host, dbh.Identifier())
+	}
+	Db, Connector, err := openPool(dbh.dbtype, dbh.dsn(Host))
+	if err != nil {
+		return fmt.Errorf("replica '%s' for %s: %s", Host, dbh.Identifier(), err)
+	}
+	Replica := &dbReplica{Host: Host, DB: Db, connector: Connector}
+	Replica.setHealth(Db.Ping())
+	dbh.replicaLock.Lock()
+	dbh.replicas = append(dbh.replicas, Replica)
+	dbh.replicaLock.Unlock()
+	log.Debugf("Added replica '%s' to %s (healthy: %t)\n", Host, dbh.Identifier(), Replica.isHealthy())
+	return nil
+}
+
+func (dbh *DbHandle) connectReplicas() {
+	for _, Host := range dbh.ReplicaHosts {
+		log.ErrorIff(dbh.AddReplica(Host), "connecting replica")
+	}
+	dbh.replicaLock.Lock()
+	defer dbh.replicaLock.Unlock()
+	if len(dbh.replicas) > 0 && dbh.replicaStop == nil {
+		dbh.replicaStop = make(chan struct{})
+		go dbh.watchReplicas(dbh.replicaStop)
+	}
+}
+
+func (dbh *DbHandle) watchReplicas(Stop chan struct{}) {
+	Interval := dbh.ReplicaCheck
+	if Interval <= 0 {
+		Interval = DefaultReplicaCheck
+	}
+	for {
+		select {
+		case <-Stop:
+			return
+		case <-time.After(Interval):
+		}
+		dbh.replicaLock.RLock()
+		Replicas := dbh.replicas
+		dbh.replicaLock.RUnlock()
+		for _, r := range Replicas {
+			ctx, cancel := context.WithTimeout(context.Background(), Interval)
+			err := r.DB.PingContext(ctx)
+			cancel()
+			if r.setHealth(err) {
+				if err == nil {
+					log.Infof("Replica '%s' of %s is back up.\n", r.Host, dbh.Identifier())
+				} else {
+					log.Warnf("Replica '%s' of %s is down: %s\n", r.Host, dbh.Identifier(), err)
+				}
+			}
+		}
+	}
+}
+
+// CloseReplicas stops the health checks and closes every replica; queries go
+// to the primary from then on.
+func (dbh *DbHandle) CloseReplicas() {
+	dbh.replicaLock.Lock()
+	Replicas, Stop := dbh.replicas, dbh.replicaStop
+	dbh.replicas, dbh.replicaStop = nil, nil
+	dbh.replicaLock.Unlock()
+	if Stop != nil {
+		close(Stop)
+	}
+	dbh.forgetReplicas(Replicas)
+	for _, r := range Replicas {
+		log.ErrorIff(r.DB.Close(), "closing replica '%s' of %s", r.Host, dbh.Identifier())
+	}
+}
+
+// forgetReplicas drops the statements prepared on Gone from every Stmt the
+// handle knows of.
+func (dbh *DbHandle) forgetReplicas(Gone []*dbReplica) {
+	if len(Gone) == 0 {
+		return
+	}
+	Stmts := dbh.registeredStmts()
+	if dbh.prepCache != nil {
+		Stmts = append(Stmts, dbh.prepCache.all()...)
+	}
+	for _, sth := range Stmts {
+		sth.replicaLock.Lock()
+		for _, r := range Gone {
+			if Prepared, found := sth.replicaStmts[r]; found {
+				Prepared.Close()
+				delete(sth.replicaStmts, r)
+			}
+		}
+		sth.replicaLock.Unlock()
+	}
+}
+
+func (dbh *DbHandle) replicaCount() int {
+	dbh.replicaLock.RLock()
+	defer dbh.replicaLock.RUnlock()
+	return len(dbh.replicas)
+}
+
+func (dbh *DbHandle) replicaDown(r *dbReplica, err error) {
+	if r.setHealth(err) {
+		log.Warnf("Replica '%s' of %s lost; falling back to primary: %s\n", r.Host, dbh.Identifier(), err)
+	}
+}
+
+func (dbh *DbHandle) pickReplica() *dbReplica {
+	dbh.replicaLock.RLock()
+	defer dbh.replicaLock.RUnlock()
+	Count := len(dbh.replicas)
+	for i := 0; i < Count; i++ {
+		r := dbh.replicas[int(atomic.AddUint32(&dbh.replicaNext, 1))%Count]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (dbh *DbHandle) ReplicaStatus() []ReplicaStatus {
+	dbh.replicaLock.RLock()
+	defer dbh.replicaLock.RUnlock()
+	var Status []ReplicaStatus
+	for _, r := range dbh.replicas {
+		r.lock.Lock()
+		Rs := ReplicaStatus{Host: r.Host, Healthy: r.isHealthy(), LastCheck: r.lastCheck}
+		if r.lastErr != nil {
+			Rs.LastErr = r.lastErr.Error()
+		}
+		r.lock.Unlock()
+		Status = append(Status, Rs)
+	}
+	return Status
+}
+
+// FromReplica gives the statement marked as safe to serve from a replica. It's a view sharing the prepared statement; the Stmt it's
+// called on is left alone, since with the prepare cache on that's shared by
+// everyone preparing the same SQL.
+func (sth *Stmt) FromReplica() *Stmt {
+	return sth.routed(routeReplica)
+}
+
+// FromPrimary gives the statement pinned to the primary, likewise.
+func (sth *Stmt) FromPrimary() *Stmt {
+	return sth.routed(routePrimary)
+}
+
+func (sth *Stmt) root() *Stmt {
+	if sth.base != nil {
+		return sth.base
+	}
+	return sth
+}
+
+func (sth *Stmt) routed(Route stmtRoute) *Stmt {
+	if sth.tx != nil {
+		return sth
+	}
+	if sth.cacheSettings() {
+		return sth.view(Route)
+	}
+	Base := sth.root()
+	if Route == routeDefault {
+		return Base
+	}
+	Base.replicaLock.Lock()
+	defer Base.replicaLock.Unlock()
+	if Base.routes[Route] == nil {
+		Base.routes[Route] = Base.view(Route)
+	}
+	return Base.routes[Route]
+}
+
+// view gives a Stmt sharing sth's prepared statement, with its own route and
+// result cache settings.
+func (sth *Stmt) view(Route stmtRoute) *Stmt {
+	Base := sth.root()
+	return &Stmt{Stmt: Base.current(), dbh: Base.dbh, sql: Base.sql,
+		argorder: Base.argorder, failure: Base.prepErr(), route: Route, base: Base,
+		cacheTTL: sth.cacheTTL, cacheTags: sth.cacheTags, invalidates: sth.invalidates}
+}
+
+func (sth *Stmt) replicaFor() *dbReplica {
+	if sth.tx != nil || sth.dbh == nil || sth.route == routePrimary || sth.dbh.replicaCount() == 0 {
+		return nil
+	}
+	if sth.route == routeDefault && !sth.dbh.ReadOnly {
+		return nil
+	}
+	return sth.dbh.pickReplica()
+}
+
+func (sth *Stmt) replicaStmt(ctx context.Context, r *dbReplica) (*sql.Stmt, error) {
+	sth = sth.root()
+	sth.replicaLock.Lock()
+	defer sth.replicaLock.Unlock()
+	if Prepared, found := sth.replicaStmts[r]; found {
+		return Prepared, nil
+	}
+	Prepared, err := r.DB.PrepareContext(ctx, sth.sql)
+	if err != nil {
+		return nil, err
+	}
+	if sth.replicaStmts == nil {
+		sth.replicaStmts = make(map[*dbReplica]*sql.Stmt)
+	}
+	sth.replicaStmts[r] = Prepared
+	return Prepared, nil
+}
+
+// closeReplicaStmts closes the statement's copies on the replicas; they're
+// prepared again when next needed.
+func (sth *Stmt) closeReplicaStmts() {
+	sth = sth.root()
+	sth.replicaLock.Lock()
+	Stmts := sth.replicaStmts
+	sth.replicaStmts = nil
+	sth.replicaLock.Unlock()
+	for _, v := range Stmts {
+		v.Close()
+	}
+}
+
+// onReplica runs Fn against a replica if this statement may use one. Handled is
+// false if there was no replica, or the one we tried went away; either way the
+// caller should go to the primary.
+func (sth *Stmt) onReplica(ctx context.Context, Fn func(*sql.Stmt) error) (Handled bool, err error) {
+	r := sth.replicaFor()
+	if r == nil {
+		return false, nil
+	}
+	Prepared, err := sth.replicaStmt(ctx, r)
+	if err == nil {
+		err = Fn(Prepared)
+	}
+	if err != nil && AsDbError(err).Kind == DbErrConnectionLost {
+		sth.dbh.replicaDown(r, err)
+		return false, nil
+	}
+	if err != nil && isStaleStatement(err) {
+		// Closed under us by eviction or a re-prepare; the primary copy will cope.
+		return false, nil
+	}
+	return true, err
+}
@@ -0,0 +1,499 @@
+package shared
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Query result cache. sth.Cache(TTL, Tags...) gives a caching view of the
+statement, whose QueryRows, FetchRow and struct scanners serve repeats of the
+same arguments from memory for TTL; Query and QueryRow still go to the
+database, since a *sql.Rows or *sql.Row can only come from there. A miss runs the query, reads every row, and
+keeps them; hits and misses alike are read back through CachedRows, whose Scan
+converts the kept values much as database/sql would have.
+
+Entries go away when they expire, when the handle's limits (entries, bytes)
+push out the least recently used, or on invalidation: sth.InvalidateCache drops
+a statement's entries, InvalidateCacheTag drops everything tagged, and a write
+statement marked with sth.Invalidates(Tags...) does that itself after each
+successful Exec. Statements in a transaction always go to the database, and
+their Execs invalidate when WithTx commits rather than straight away; a read
+between such an invalidation and the commit would cache the old rows again.
+
+Cache and Invalidates leave the Stmt they're called on alone, since with the
+prepare cache on that's shared by everyone preparing the same SQL; keep the
+view they return. The cached results themselves are per handle and SQL text,
+so views of the same SQL with the same arguments share them.
+
+Counts show up per statement in QueryStats, and for the whole cache in
+ResultCacheStats.
+*/
+
+const (
+	DefaultResultCacheEntries = 1000
+	DefaultResultCacheBytes   = 32 << 20
+	DefaultResultCacheRows    = 10000
+)
+
+type ResultCacheLimits struct {
+	MaxEntries int
+	MaxBytes   int64
+	MaxRows    int // Results longer than this are returned but not kept
+}
+
+type ResultCacheStats struct {
+	Hits          int64
+	Misses        int64
+	Evictions     int64 // For space
+	Expirations   int64
+	Invalidations int64
+	Entries       int
+	Bytes         int64
+}
+
+type cachedColumn struct {
+	name     string
+	dbType   string
+	scanType reflect.Type
+	nullable bool
+	hasNull  bool
+}
+
+type cachedResult struct {
+	key     string
+	sql     string
+	tags    []string
+	columns []cachedColumn
+	rows    [][]driver.Value
+	size    int64
+	expires time.Time
+	elem    *list.Element
+}
+
+type resultCache struct {
+	lock    sync.Mutex
+	limits  ResultCacheLimits
+	entries map[string]*cachedResult
+	lru     *list.List
+	stats   ResultCacheStats
+}
+
+func newResultCache(Limits ResultCacheLimits) *resultCache {
+	if Limits.MaxEntries <= 0 {
+		Limits.MaxEntries = DefaultResultCacheEntries
+	}
+	if Limits.MaxBytes <= 0 {
+		Limits.MaxBytes = DefaultResultCacheBytes
+	}
+	if Limits.MaxRows <= 0 {
+		Limits.MaxRows = DefaultResultCacheRows
+	}
+	return &resultCache{limits: Limits, entries: make(map[string]*cachedResult), lru: list.New()}
+}
+
+func (dbh *DbHandle) resultCache() *resultCache {
+	dbh.resultsLock.Lock()
+	defer dbh.resultsLock.Unlock()
+	if dbh.results == nil {
+		dbh.results = newResultCache(ResultCacheLimits{})
+	}
+	return dbh.results
+}
+
+// SetResultCacheLimits replaces the handle's result cache, emptying it.
+func (dbh *DbHandle) SetResultCacheLimits(Limits ResultCacheLimits) *DbHandle {
+	dbh.resultsLock.Lock()
+	dbh.results = newResultCache(Limits)
+	dbh.resultsLock.Unlock()
+	return dbh
+}
+
+func (dbh *DbHandle) ResultCacheStats() ResultCacheStats {
+	c := dbh.resultCache()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	Stats := c.stats
+	Stats.Entries = len(c.entries)
+	return Stats
+}
+
+// Cache gives a view of the statement with result caching on; a TTL of zero
+// turns it off. Statements in a transaction are returned as they are.
+func (sth *Stmt) Cache(TTL time.Duration, Tags ...string) *Stmt {
+	if sth.tx != nil {
+		return sth
+	}
+	View := sth.view(sth.route)
+	View.cacheTTL, View.cacheTags = TTL, Tags
+	return View
+}
+
+// Invalidates gives a view of the statement whose successful Execs drop the
+// cached results carrying any of Tags.
+func (sth *Stmt) Invalidates(Tags ...string) *Stmt {
+	if sth.tx != nil {
+		return sth
+	}
+	View := sth.view(sth.route)
+	View.invalidates = Tags
+	return View
+}
+
+// cacheSettings reports whether sth is a view with Cache or Invalidates set.
+func (sth *Stmt) cacheSettings() bool {
+	return sth.cacheTTL > 0 || len(sth.invalidates) > 0
+}
+
+func (sth *Stmt) InvalidateCache() {
+	sth.dbh.resultCache().drop(func(e *cachedResult) bool {
+		return e.sql == sth.sql
+	})
+}
+
+func (dbh *DbHandle) InvalidateCacheTag(Tags ...string) {
+	dbh.resultCache().drop(func(e *cachedResult) bool {
+		for _, v := range e.tags {
+			for _, Tag := range Tags {
+				if v == Tag {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+func (dbh *DbHandle) InvalidateResultCache() {
+	dbh.resultCache().drop(func(*cachedResult) bool { return true })
+}
+
+func (c *resultCache) drop(Match func(*cachedResult) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range c.entries {
+		if Match(e) {
+			c.remove(e)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+func (c *resultCache) remove(e *cachedResult) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.stats.Bytes -= e.size
+}
+
+func (c *resultCache) get(Key string) *cachedResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, found := c.entries[Key]
+	if found && time.Now().After(e.expires) {
+		c.remove(e)
+		c.stats.Expirations++
+		found = false
+	}
+	if !found {
+		c.stats.Misses++
+		return nil
+	}
+	c.lru.MoveToFront(e.elem)
+	c.stats.Hits++
+	return e
+}
+
+func (c *resultCache) put(e *cachedResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(e.rows) > c.limits.MaxRows || e.size > c.limits.MaxBytes {
+		return
+	}
+	if Old, found := c.entries[e.key]; found {
+		c.remove(Old)
+	}
+	for len(c.entries) >= c.limits.MaxEntries || c.stats.Bytes+e.size > c.limits.MaxBytes {
+		Oldest := c.lru.Back()
+		if Oldest == nil {
+			break
+		}
+		c.remove(Oldest.Value.(*cachedResult))
+		c.stats.Evictions++
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = e
+	c.stats.Bytes += e.size
+}
+
+func (sth *Stmt) cacheable() bool {
+	return sth.cacheTTL > 0 && sth.tx == nil && sth.prepErr() == nil
+}
+
+func (sth *Stmt) cacheKey(args []interface{}) string {
+	var Buf strings.Builder
+	Buf.WriteString(sth.sql)
+	for _, v := range args {
+		Buf.WriteByte(0)
+		v = lookupKeyValue(v)
+		fmt.Fprintf(&Buf, "%T:%v", v, v)
+	}
+	return Buf.String()
+}
+
+func (sth *Stmt) recordCache(Hit bool) {
+	sth.dbh.stats.lock.Lock()
+	defer sth.dbh.stats.lock.Unlock()
+	if sth.dbh.stats.queries == nil {
+		sth.dbh.stats.queries = make(map[string]*QueryStat)
+	}
+	Stat, found := sth.dbh.stats.queries[sth.sql]
+	if !found {
+		Stat = &QueryStat{Sql: sth.sql}
+		sth.dbh.stats.queries[sth.sql] = Stat
+	}
+	if Hit {
+		Stat.CacheHits++
+		sth.dbh.stats.totals.CacheHits++
+	} else {
+		Stat.CacheMisses++
+		sth.dbh.stats.totals.CacheMisses++
+	}
+}
+
+// cachedResultFor returns the kept result for args, running the query if
+// there isn't one.
+func (sth *Stmt) cachedResultFor(ctx context.Context, args []interface{}) (*cachedResult, error) {
+	Cache := sth.dbh.resultCache()
+	Key := sth.cacheKey(args)
+	if e := Cache.get(Key); e != nil {
+		sth.recordCache(true)
+		return e, nil
+	}
+	sth.recordCache(false)
+	Rows, err := sth.queryDirect(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	defer Rows.Close()
+	e, err := readCachedResult(Rows)
+	if err != nil {
+		return nil, dbErrorOrNil(err)
+	}
+	e.key, e.sql, e.tags = Key, sth.sql, sth.cacheTags
+	e.expires = time.Now().Add(sth.cacheTTL)
+	Cache.put(e)
+	return e, nil
+}
+
+func readCachedResult(Rows *sql.Rows) (*cachedResult, error) {
+	Types, err := Rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	e := &cachedResult{}
+	for _, v := range Types {
+		Col := cachedColumn{name: v.Name(), dbType: v.DatabaseTypeName(), scanType: v.ScanType()}
+		Col.nullable, Col.hasNull = v.Nullable()
+		e.columns = append(e.columns, Col)
+		e.size += int64(len(Col.name))
+	}
+	for Rows.Next() {
+		Vals := make([]interface{}, len(Types))
+		Targets := make([]interface{}, len(Types))
+		for i := range Vals {
+			Targets[i] = &Vals[i]
+		}
+		if err = Rows.Scan(Targets...); err != nil {
+			return nil, err
+		}
+		Row := make([]driver.Value, len(Vals))
+		for i, v := range Vals {
+			Row[i] = v
+			switch Val := v.(type) {
+			case []byte:
+				e.size += int64(len(Val))
+			case string:
+				e.size += int64(len(Val))
+			}
+			e.size += 16
+		}
+		e.rows = append(e.rows, Row)
+	}
+	return e, Rows.Err()
+}
+
+// Rows is what CachedRows and *sql.Rows have in common.
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Columns() ([]string, error)
+	Err() error
+	Close() error
+}
+
+// CachedRows reads back a kept result, like *sql.Rows does a live one.
+type CachedRows struct {
+	e      *cachedResult
+	pos    int
+	closed bool
+}
+
+func (r *CachedRows) Next() bool {
+	if r.closed || r.pos >= len(r.e.rows) {
+		r.closed = true
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *CachedRows) Scan(dest ...interface{}) error {
+	if r.closed || r.pos == 0 {
+		return fmt.Errorf("sql: Scan called without calling Next")
+	}
+	Row := r.e.rows[r.pos-1]
+	if len(dest) != len(Row) {
+		return fmt.Errorf("sql: expected %d destination arguments in Scan, not %d", len(Row), len(dest))
+	}
+	for i, v := range Row {
+		if err := convertCached(dest[i], v); err != nil {
+			return fmt.Errorf("sql: Scan error on column index %d, name %q: %w", i, r.e.columns[i].name, err)
+		}
+	}
+	return nil
+}
+
+func (r *CachedRows) Columns() ([]string, error) {
+	var Names []string
+	for _, v := range r.e.columns {
+		Names = append(Names, v.name)
+	}
+	return Names, nil
+}
+
+func (r *CachedRows) Err() error {
+	return nil
+}
+
+func (r *CachedRows) Close() error {
+	r.closed = true
+	return nil
+}
+
+// QueryRows is Query which, on a statement from Cache, is served from the
+// result cache.
+func (sth *Stmt) QueryRows(ctx context.Context, args ...interface{}) (Rows, error) {
+	if err := sth.prepErr(); err != nil {
+		return nil, err
+	}
+	if !sth.cacheable() {
+		return sth.queryDirect(ctx, args)
+	}
+	if ctx == nil {
+		ctx = sth.dbh.baseContext()
+	}
+	Result, err := sth.cachedResultFor(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedRows{e: Result}, nil
+}
+
+// convertCached stores a kept value in Dest, as Rows.Scan would the value from
+// the driver: through sql.Scanner if Dest is one, following pointers for NULL,
+// and converting between strings, numbers and bools.
+func convertCached(Dest interface{}, Src driver.Value) error {
+	if Bytes, isBytes := Src.([]byte); isBytes {
+		Src = append([]byte(nil), Bytes...)
+	}
+	if Scanner, isScanner := Dest.(sql.Scanner); isScanner {
+		return Scanner.Scan(Src)
+	}
+	if Any, isAny := Dest.(*interface{}); isAny {
+		*Any = Src
+		return nil
+	}
+	Ptr := reflect.ValueOf(Dest)
+	if Ptr.Kind() != reflect.Ptr || Ptr.IsNil() {
+		return fmt.Errorf("destination not a pointer")
+	}
+	Target := Ptr.Elem()
+	if Target.Kind() == reflect.Ptr {
+		if Src == nil {
+			Target.Set(reflect.Zero(Target.Type()))
+			return nil
+		}
+		Fresh := reflect.New(Target.Type().Elem())
+		if err := convertCached(Fresh.Interface(), Src); err != nil {
+			return err
+		}
+		Target.Set(Fresh)
+		return nil
+	}
+	if Src == nil {
+		if Target.Kind() == reflect.Slice {
+			Target.Set(reflect.Zero(Target.Type()))
+			return nil
+		}
+		return fmt.Errorf("converting NULL to %s is unsupported", Target.Type())
+	}
+	if reflect.TypeOf(Src).AssignableTo(Target.Type()) {
+		Target.Set(reflect.ValueOf(Src))
+		return nil
+	}
+	Text := cachedText(Src)
+	var err error
+	switch Target.Kind() {
+	case reflect.String:
+		Target.SetString(Text)
+	case reflect.Slice:
+		if Target.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported Scan, storing %T into %s", Src, Target.Type())
+		}
+		Target.SetBytes([]byte(Text))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var N int64
+		N, err = strconv.ParseInt(Text, 10, Target.Type().Bits())
+		Target.SetInt(N)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var N uint64
+		N, err = strconv.ParseUint(Text, 10, Target.Type().Bits())
+		Target.SetUint(N)
+	case reflect.Float32, reflect.Float64:
+		var N float64
+		N, err = strconv.ParseFloat(Text, Target.Type().Bits())
+		Target.SetFloat(N)
+	case reflect.Bool:
+		var B driver.Value
+		B, err = driver.Bool.ConvertValue(Src)
+		if err == nil {
+			Target.SetBool(B.(bool))
+		}
+	default:
+		return fmt.Errorf("unsupported Scan, storing %T into %s", Src, Target.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("converting %T %q to %s: %w", Src, Text, Target.Type(), err)
+	}
+	return nil
+}
+
+func cachedText(Src driver.Value) string {
+	switch Val := Src.(type) {
+	case string:
+		return Val
+	case []byte:
+		return string(Val)
+	case time.Time:
+		return Val.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(Src)
+}
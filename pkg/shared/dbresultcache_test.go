@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Fake.On(`^SELECT id, name, price, listed FROM markets`).WithArgs("btc-usd").Return([]string{"id", "name", "price", "listed"},
+		[]interface{}{int64(1), "btc-usd", nil, true})
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	Shared := dbh.Prepare("SELECT id, name, price, listed FROM markets WHERE name=$1;")
+	Cached := Shared.Cache(time.Minute, "markets")
+	if Shared.cacheable() {
+		t.Errorf("Cache() changed the statement it was called on")
+	}
+	Name := "btc-usd"
+	for i := 0; i < 2; i++ {
+		var (
+			Id     int
+			Label  sql.NullString
+			Price  *float64
+			Listed bool
+		)
+		// A pointer argument has to hit the same entry as the value would.
+		Arg := interface{}(&Name)
+		if i == 1 {
+			Arg = Name
+		}
+		if err := Cached.FetchRow(nil, Arg).Scan(&Id, &Label, &Price, &Listed); err != nil {
+			t.Fatalf("pass %d: %s", i, err)
+		}
+		if Id != 1 || Label.String != "btc-usd" || Price != nil || !Listed {
+			t.Errorf("pass %d: got %d, %+v, %v, %t", i, Id, Label, Price, Listed)
+		}
+	}
+	if Calls := Fake.CallsMatching(`^SELECT`); len(Calls) != 1 {
+		t.Errorf("%d queries reached the db; want 1", len(Calls))
+	}
+
+	type market struct {
+		Id   int
+		Name string
+	}
+	var Markets []market
+	if err := Cached.QueryStructs(&Markets, Name); err != nil {
+		t.Fatalf("QueryStructs: %s", err)
+	}
+	if len(Markets) != 1 || Markets[0].Name != "btc-usd" {
+		t.Errorf("QueryStructs gave %+v", Markets)
+	}
+	if err := Cached.FetchRow(nil, "eth-usd").Scan(new(int), new(string), new(*float64), new(bool)); err != sql.ErrNoRows {
+		t.Errorf("a cached miss gave %v, not sql.ErrNoRows", err)
+	}
+
+	Update := dbh.Prepare("UPDATE markets SET price=$1 WHERE name=$2;").Invalidates("markets")
+	if _, err := Update.Exec(1.5, Name); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if Cached.FetchRow(nil, Name).Scan(new(int), new(string), new(*float64), new(bool)); len(Fake.CallsMatching(`^SELECT`)) != 3 {
+		t.Errorf("Invalidates didn't drop the cached result")
+	}
+}
+
+func TestResultCacheTxInvalidates(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Fake.On(`^SELECT price FROM markets`).Return([]string{"price"}, []interface{}{1.5})
+	Fake.On(`^UPDATE markets`).Affected(1)
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	Cached := dbh.Prepare("SELECT price FROM markets WHERE name=$1;").Cache(time.Minute, "markets")
+	Update := dbh.Prepare("UPDATE markets SET price=$1 WHERE name=$2;").Invalidates("markets")
+	Selects := func() int {
+		Cached.FetchRow(nil, "btc-usd").Scan(new(float64))
+		return len(Fake.CallsMatching(`^SELECT`))
+	}
+	if Got := Selects(); Got != 1 {
+		t.Fatalf("%d selects to fill the cache", Got)
+	}
+	Rollback := errors.New("rolled back")
+	err := dbh.WithTx(nil, nil, func(tx *Tx) error {
+		if _, err := tx.Stmt(Update).Exec(2.5, "btc-usd"); err != nil {
+			return err
+		}
+		return Rollback
+	})
+	if !errors.Is(err, Rollback) {
+		t.Fatalf("rolled back transaction gave %v", err)
+	}
+	if Got := Selects(); Got != 1 {
+		t.Errorf("a rolled back update invalidated the cache")
+	}
+	err = dbh.WithTx(nil, nil, func(tx *Tx) error {
+		_, err := tx.Stmt(Update).Exec(2.5, "btc-usd")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("transaction: %s", err)
+	}
+	if Got := Selects(); Got != 2 {
+		t.Errorf("a committed update didn't invalidate the cache (%d selects)", Got)
+	}
+}
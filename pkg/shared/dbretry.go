@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+/*
+Retry policies for transient database errors. Errors are classified through
+DbHandle.ErrorKind; only the classes listed in RetryOn are retried, with a
+jittered exponential backoff, until either MaxAttempts or Budget runs out.
+
+A handle only retries once it has a policy: SetRetryPolicy in code, or the
+ini's retries (total attempts) with an optional retrybudget, which start from
+DefaultRetryPolicy. A policy with neither MaxAttempts nor Budget set doesn't
+retry at all, rather than retrying forever.
+
+Connection loss is only retried for reads and whole transactions. A bare Exec
+that dies mid-flight may or may not have been applied, so we don't guess.
+*/
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Budget      time.Duration
+	RetryOn     []DbErrorKind
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Budget:      15 * time.Second,
+	RetryOn:     []DbErrorKind{DbErrDeadlock, DbErrSerializationFailure, DbErrTooManyConnections, DbErrConnectionLost},
+}
+
+func (p *RetryPolicy) retries(Kind DbErrorKind, IsWrite bool) bool {
+	if IsWrite && Kind == DbErrConnectionLost {
+		return false
+	}
+	for _, v := range p.RetryOn {
+		if v == Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(Attempt int) time.Duration {
+	Delay := p.BaseDelay << uint(Attempt)
+	if Delay <= 0 || (p.MaxDelay > 0 && Delay > p.MaxDelay) {
+		Delay = p.MaxDelay
+	}
+	if Delay <= 0 {
+		return 0
+	}
+	// Full jitter on the upper half, so two deadlocked peers don't collide again.
+	return Delay/2 + time.Duration(rand.Int63n(int64(Delay/2)+1))
+}
+
+func (dbh *DbHandle) SetRetryPolicy(Policy *RetryPolicy) *DbHandle {
+	dbh.retry = Policy
+	return dbh
+}
+
+func (dbh *DbHandle) RetryPolicy() *RetryPolicy {
+	return dbh.retry
+}
+
+// WithRetry runs Fn, re-running it while it fails with an error the handle's
+// retry policy considers transient. Fn must be safe to repeat.
+func (dbh *DbHandle) WithRetry(Label string, Fn func() error) error {
+	return dbh.withRetry(nil, Label, false, Fn)
+}
+
+func (dbh *DbHandle) withRetry(ctx context.Context, Label string, IsWrite bool, Fn func() error) error {
+	err := Fn()
+	if err != nil && dbh != nil && dbh.rotateOnAuthFailure(err) {
+		err = Fn()
+	}
+	if err == nil || dbh == nil || dbh.retry == nil {
+		return err
+	}
+	Policy := dbh.retry
+	if Policy.MaxAttempts <= 0 && Policy.Budget <= 0 {
+		return err
+	}
+	Started := time.Now()
+	for Attempt := 1; Policy.MaxAttempts <= 0 || Attempt < Policy.MaxAttempts; Attempt++ {
+		Kind := dbh.ErrorKind(err)
+		if !Policy.retries(Kind, IsWrite) {
+			return err
+		}
+		Delay := Policy.backoff(Attempt - 1)
+		if Policy.Budget > 0 && time.Since(Started)+Delay > Policy.Budget {
+			log.Warnf("%s: giving up on '%s' after %d attempts in %s; retry budget %s exhausted: %s\n",
+				dbh.Identifier(), Label, Attempt, time.Since(Started), Policy.Budget, err)
+			return err
+		}
+		log.Warnf("%s: retry %d of '%s' in %s after %s: %s\n",
+			dbh.Identifier(), Attempt, Label, Delay, Kind.String(), err)
+		if ctx == nil {
+			time.Sleep(Delay)
+		} else {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(Delay):
+			}
+		}
+		err = Fn()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (dbh *DbHandle) ApplyTxBlock(Blocks []TxBlock) error {
+	return dbErrorOrNil(dbh.WithRetry("transaction block", func() error {
+		return ApplyTxBlock(dbh.DB, Blocks)
+	}))
+}
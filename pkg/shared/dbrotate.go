@@ -0,0 +1,273 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+Credential rotation. A handle made from a Configuration section remembers it,
+and RotateCredentials re-reads the section's dbuser/dbpass (reloading the ini
+files first, so an edited secrets file is seen). If they changed, they're tried
+on a throwaway connection; only once that works does the handle switch over.
+
+The switch doesn't replace the pool. Each pool (the primary's and every
+replica's) connects through a dsnConnector, which is pointed at the new DSN, so
+connections opened from then on use the new credentials while statements,
+transactions and connections already in use carry on undisturbed; servers don't
+re-check a session's password, so those connections stay good until the pool
+retires them. Listeners, which hold a connection of their own, are moved to one
+made with the new credentials.
+
+This happens by itself when a statement fails authentication (at most once per
+RotationMinInterval), and for every handle of a Configuration on SIGHUP (or
+other signals) once RotateDbsOnSignal is called.
+*/
+
+const RotationMinInterval = 30 * time.Second
+
+type dbRotation struct {
+	lock       sync.Mutex
+	last       time.Time     // Of the last change of credentials
+	credLock   sync.RWMutex  // Over the handle's Username and Password
+	connector  *dsnConnector // The primary pool's
+	listeners  map[*DbListener]bool
+	listenLock sync.Mutex
+}
+
+// dsnConnector opens connections with whatever DSN it was last given.
+type dsnConnector struct {
+	open    func(Dsn string) (driver.Connector, error)
+	lock    sync.RWMutex
+	current driver.Connector
+}
+
+func (c *dsnConnector) setDsn(Dsn string) error {
+	Connector, err := c.open(Dsn)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.current = Connector
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *dsnConnector) get() driver.Connector {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.current
+}
+
+func (c *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.get().Connect(ctx)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.get().Driver()
+}
+
+// openPool opens a pool on Dsn whose credentials rotation can change.
+func openPool(Dialect DbType, Dsn string) (*sql.DB, *dsnConnector, error) {
+	Connector := &dsnConnector{open: func(Dsn string) (driver.Connector, error) {
+		return mysql.MySQLDriver{}.OpenConnector(Dsn)
+	}}
+	if Dialect == DbTypePostgres {
+		Connector.open = func(Dsn string) (driver.Connector, error) {
+			return pq.NewConnector(Dsn)
+		}
+	}
+	if err := Connector.setDsn(Dsn); err != nil {
+		return nil, nil, err
+	}
+	return sql.OpenDB(Connector), Connector, nil
+}
+
+// credentials reads Username and Password, which rotation may be changing.
+func (dbh *DbHandle) credentials() (string, string) {
+	dbh.rotation.credLock.RLock()
+	defer dbh.rotation.credLock.RUnlock()
+	return dbh.Username, dbh.Password
+}
+
+func (dbh *DbHandle) dsn(Host string) string {
+	if dbh.dbtype == DbTypePostgres {
+		return dbh.pgDsn(Host)
+	}
+	return dbh.mysqlDsn(Host)
+}
+
+func (r *dbRotation) addListener(l *DbListener) {
+	r.listenLock.Lock()
+	defer r.listenLock.Unlock()
+	if r.listeners == nil {
+		r.listeners = make(map[*DbListener]bool)
+	}
+	r.listeners[l] = true
+}
+
+func (r *dbRotation) removeListener(l *DbListener) {
+	r.listenLock.Lock()
+	defer r.listenLock.Unlock()
+	delete(r.listeners, l)
+}
+
+func (r *dbRotation) listening() []*DbListener {
+	r.listenLock.Lock()
+	defer r.listenLock.Unlock()
+	var Listeners []*DbListener
+	for l := range r.listeners {
+		Listeners = append(Listeners, l)
+	}
+	return Listeners
+}
+
+// isAuthFailure reports whether err means the server refused our credentials.
+func isAuthFailure(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == mysqlerr.ER_ACCESS_DENIED_ERROR
+	}
+	var pgErr *pq.Error
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code.Name() {
+		case "invalid_password", "invalid_authorization_specification":
+			return true
+		}
+	}
+	return false
+}
+
+// ReloadIni re-reads the ini files behind config, its override and fallback.
+func (config *Configuration) ReloadIni() error {
+	for _, v := range []*Configuration{config, config.Override, config.Fallback} {
+		if v == nil || v.IniFile == nil {
+			continue
+		}
+		if err := v.IniFile.Reload(); err != nil {
+			return fmt.Errorf("reloading '%s': %w", v.IniPath, err)
+		}
+	}
+	return nil
+}
+
+// RotateCredentials switches the handle to the credentials now in its config
+// section, if they've changed.
+func (dbh *DbHandle) RotateCredentials() error {
+	_, err := dbh.rotateCredentials(true)
+	return err
+}
+
+func (dbh *DbHandle) rotateCredentials(Reload bool) (bool, error) {
+	if dbh.config == nil {
+		return false, fmt.Errorf("%s wasn't made from a config section; nowhere to get new credentials", dbh.Identifier())
+	}
+	if dbh.fake {
+		return false, nil
+	}
+	dbh.rotation.lock.Lock()
+	defer dbh.rotation.lock.Unlock()
+	if Reload {
+		if err := dbh.config.ReloadIni(); err != nil {
+			log.Warnf("Rotating credentials for %s: %s; using what's loaded\n", dbh.Identifier(), err)
+		}
+	}
+	_, User := dbh.config.GetString(dbh.Section + ".dbuser")
+	_, Pass := dbh.config.GetString(dbh.Section + ".dbpass")
+	if OldUser, OldPass := dbh.credentials(); User == OldUser && Pass == OldPass {
+		log.Debugf("Credentials for %s are unchanged.\n", dbh.Identifier())
+		return false, nil
+	}
+	// Try them on a connection of their own before touching the handle.
+	Probe := &DbHandle{Host: dbh.Host, DbName: dbh.DbName, Username: User, Password: Pass,
+		dbtype: dbh.dbtype, TimeZone: dbh.TimeZone}
+	Driver := "mysql"
+	if dbh.dbtype == DbTypePostgres {
+		Driver = "postgres"
+	}
+	Test, err := sql.Open(Driver, Probe.dsn(dbh.Host))
+	if err == nil {
+		ctx, cancel := dbh.statementContext(nil)
+		err = Test.PingContext(ctx)
+		cancel()
+		Test.Close()
+	}
+	if err != nil {
+		return false, fmt.Errorf("new credentials for %s don't work: %w", dbh.Identifier(), dbErrorOrNil(err))
+	}
+	dbh.rotation.credLock.Lock()
+	dbh.Username, dbh.Password = User, Pass
+	dbh.rotation.credLock.Unlock()
+	dbh.rotation.last = time.Now()
+	if dbh.rotation.connector != nil {
+		log.ErrorIff(dbh.rotation.connector.setDsn(dbh.dsn(dbh.Host)), "switching %s to new credentials", dbh.Identifier())
+	}
+	dbh.replicaLock.RLock()
+	for _, r := range dbh.replicas {
+		if r.connector != nil {
+			log.ErrorIff(r.connector.setDsn(dbh.dsn(r.Host)), "switching replica '%s' to new credentials", r.Host)
+		}
+	}
+	dbh.replicaLock.RUnlock()
+	for _, l := range dbh.rotation.listening() {
+		log.ErrorIff(l.reconnect(), "moving listener on %s to new credentials", dbh.Identifier())
+	}
+	log.Infof("Rotated credentials for %s (user '%s').\n", dbh.Identifier(), User)
+	return true, nil
+}
+
+// rotateOnAuthFailure rotates if err is an authentication failure and we
+// haven't tried lately; it reports whether the credentials changed.
+func (dbh *DbHandle) rotateOnAuthFailure(err error) bool {
+	if dbh.config == nil || !isAuthFailure(err) {
+		return false
+	}
+	dbh.rotation.lock.Lock()
+	Recent := time.Since(dbh.rotation.last) < RotationMinInterval
+	dbh.rotation.lock.Unlock()
+	if Recent {
+		return false
+	}
+	log.Warnf("Authentication failed on %s; re-reading credentials.\n", dbh.Identifier())
+	Changed, err := dbh.rotateCredentials(true)
+	log.ErrorIff(err, "rotating credentials")
+	return Changed
+}
+
+// RotateDbsOnSignal rotates the credentials of every handle made through
+// ConnectDbBySection when one of Sigs (SIGHUP if none) arrives, until ctx is
+// cancelled.
+func (config *Configuration) RotateDbsOnSignal(ctx context.Context, Sigs ...os.Signal) {
+	if len(Sigs) == 0 {
+		Sigs = []os.Signal{syscall.SIGHUP}
+	}
+	Ch := make(chan os.Signal, 1)
+	signal.Notify(Ch, Sigs...)
+	go func() {
+		defer signal.Stop(Ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case Sig := <-Ch:
+				log.Infof("Got %s; rotating database credentials.\n", Sig)
+				log.ErrorIff(config.ReloadIni(), "reloading config")
+				for _, dbh := range config.dbHandles() {
+					_, err := dbh.rotateCredentials(false)
+					log.ErrorIff(err, "rotating credentials")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,208 @@
+package shared
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Maps result columns onto struct fields. A field is matched by its `db` tag if it
+has one (`db:"-"` skips the field), otherwise by its name, case-insensitively, so
+that Postgres' lowercased column names still land in CamelCase fields. Fields of
+embedded structs are promoted the same way encoding/json does it. NULLs need a
+pointer field or one of the sql.Null* types; anything else will fail the scan.
+*/
+
+type structFieldMap map[string][]int
+
+var structFieldMaps sync.Map
+
+func structFieldsOf(Type reflect.Type) structFieldMap {
+	if Cached, found := structFieldMaps.Load(Type); found {
+		return Cached.(structFieldMap)
+	}
+	Fields := make(structFieldMap)
+	walkStructFields(Type, nil, Fields)
+	structFieldMaps.Store(Type, Fields)
+	return Fields
+}
+
+func walkStructFields(Type reflect.Type, Index []int, Fields structFieldMap) {
+	for i := 0; i < Type.NumField(); i++ {
+		Field := Type.Field(i)
+		Tag := Field.Tag.Get("db")
+		if Tag == "-" {
+			continue
+		}
+		Path := append(append([]int{}, Index...), i)
+		if Field.Anonymous && Tag == "" {
+			Inner := Field.Type
+			if Inner.Kind() == reflect.Ptr {
+				Inner = Inner.Elem()
+			}
+			if Inner.Kind() == reflect.Struct && !reflect.PtrTo(Inner).Implements(scannerType) {
+				walkStructFields(Inner, Path, Fields)
+				continue
+			}
+		}
+		if Field.PkgPath != "" {
+			continue
+		}
+		Name := Tag
+		if Name == "" {
+			Name = Field.Name
+		}
+		Name = strings.ToLower(Name)
+		// Shallower fields win, same as Go's own promotion rules.
+		if Existing, found := Fields[Name]; found && len(Existing) <= len(Path) {
+			continue
+		}
+		Fields[Name] = Path
+	}
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+func fieldByIndexAlloc(Value reflect.Value, Index []int) reflect.Value {
+	for i, x := range Index {
+		if i > 0 && Value.Kind() == reflect.Ptr {
+			if Value.IsNil() {
+				Value.Set(reflect.New(Value.Type().Elem()))
+			}
+			Value = Value.Elem()
+		}
+		Value = Value.Field(x)
+	}
+	return Value
+}
+
+func scanTargets(Row reflect.Value, Columns []string, Fields structFieldMap) ([]interface{}, []string) {
+	var Unmapped []string
+	Targets := make([]interface{}, len(Columns))
+	for k, Col := range Columns {
+		Index, found := Fields[strings.ToLower(Col)]
+		if !found {
+			Unmapped = append(Unmapped, Col)
+			Targets[k] = new(interface{})
+			continue
+		}
+		Targets[k] = fieldByIndexAlloc(Row, Index).Addr().Interface()
+	}
+	return Targets, Unmapped
+}
+
+// structSliceOf checks Dest is a pointer to a slice of structs (or of pointers
+// to them), returning the slice and the struct type.
+func structSliceOf(Dest interface{}) (reflect.Value, reflect.Type, bool, error) {
+	Slice := reflect.ValueOf(Dest)
+	if Slice.Kind() != reflect.Ptr || Slice.Elem().Kind() != reflect.Slice {
+		return Slice, nil, false, fmt.Errorf("ScanStructs needs a pointer to a slice, not %T", Dest)
+	}
+	Slice = Slice.Elem()
+	ElemType := Slice.Type().Elem()
+	IsPtr := ElemType.Kind() == reflect.Ptr
+	if IsPtr {
+		ElemType = ElemType.Elem()
+	}
+	if ElemType.Kind() != reflect.Struct {
+		return Slice, nil, false, fmt.Errorf("ScanStructs needs a slice of structs, not %T", Dest)
+	}
+	return Slice, ElemType, IsPtr, nil
+}
+
+// ScanStructs reads every row of Rows into Dest, which must be a pointer to a
+// slice of structs or of struct pointers. Columns with no matching field are
+// discarded and their names returned.
+func ScanStructs(Rows Rows, Dest interface{}) ([]string, error) {
+	Slice, ElemType, IsPtr, err := structSliceOf(Dest)
+	if err != nil {
+		return nil, err
+	}
+	Columns, err := Rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	Fields := structFieldsOf(ElemType)
+	var Unmapped []string
+	for Rows.Next() {
+		Row := reflect.New(ElemType)
+		var Targets []interface{}
+		Targets, Unmapped = scanTargets(Row.Elem(), Columns, Fields)
+		err = Rows.Scan(Targets...)
+		if err != nil {
+			return Unmapped, err
+		}
+		if IsPtr {
+			Slice.Set(reflect.Append(Slice, Row))
+		} else {
+			Slice.Set(reflect.Append(Slice, Row.Elem()))
+		}
+	}
+	return Unmapped, Rows.Err()
+}
+
+// ScanStruct reads the first row of Rows into Dest, a pointer to a struct.
+// It returns sql.ErrNoRows if there wasn't one.
+func ScanStruct(Rows Rows, Dest interface{}) ([]string, error) {
+	Row := reflect.ValueOf(Dest)
+	if Row.Kind() != reflect.Ptr || Row.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ScanStruct needs a pointer to a struct, not %T", Dest)
+	}
+	Columns, err := Rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	Targets, Unmapped := scanTargets(Row.Elem(), Columns, structFieldsOf(Row.Elem().Type()))
+	if !Rows.Next() {
+		if err = Rows.Err(); err != nil {
+			return Unmapped, err
+		}
+		return Unmapped, sql.ErrNoRows
+	}
+	return Unmapped, Rows.Scan(Targets...)
+}
+
+func (sth *Stmt) warnUnmapped(Unmapped []string) {
+	if len(Unmapped) == 0 || !atomic.CompareAndSwapInt32(&sth.warnedUnmapped, 0, 1) {
+		return
+	}
+	log.Warnf("%s: columns %v have no matching struct field; discarding them.\n",
+		sth.Identify(), Unmapped)
+}
+
+// QueryStructs runs the statement and appends each row to Dest (a *[]T or *[]*T).
+func (sth *Stmt) QueryStructs(Dest interface{}, args ...interface{}) error {
+	Slice, _, _, err := structSliceOf(Dest)
+	if err != nil {
+		return err
+	}
+	Rows, err := sth.QueryRows(nil, args...)
+	if err != nil {
+		return err
+	}
+	defer Rows.Close()
+	Before := Slice.Len()
+	Unmapped, err := ScanStructs(Rows, Dest)
+	sth.warnUnmapped(Unmapped)
+	sth.recordRows(int64(Slice.Len() - Before))
+	return err
+}
+
+// QueryStruct runs the statement and scans the first row into Dest (a *T).
+func (sth *Stmt) QueryStruct(Dest interface{}, args ...interface{}) error {
+	Rows, err := sth.QueryRows(nil, args...)
+	if err != nil {
+		return err
+	}
+	defer Rows.Close()
+	Unmapped, err := ScanStruct(Rows, Dest)
+	sth.warnUnmapped(Unmapped)
+	if err == nil {
+		sth.recordRows(1)
+	}
+	return err
+}
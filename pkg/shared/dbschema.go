@@ -0,0 +1,270 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+Table introspection, from information_schema on MySQL and pg_catalog on
+Postgres. Table names may be schema-qualified ("audit.events"); unqualified ones
+resolve against the connection's current database or search_path. Unique keys
+are keyed by index name and include the primary key under its own name.
+*/
+
+type ColumnInfo struct {
+	Name       string
+	Type       string // As the database spells it, e.g. "varchar(64)" or "timestamp with time zone"
+	Nullable   bool
+	Default    sql.NullString
+	PrimaryKey bool
+}
+
+type TableInfo struct {
+	Schema     string
+	Name       string
+	Columns    []ColumnInfo
+	PrimaryKey []string
+	UniqueKeys map[string][]string
+}
+
+func (ti *TableInfo) Column(Name string) *ColumnInfo {
+	for k := range ti.Columns {
+		if strings.EqualFold(ti.Columns[k].Name, Name) {
+			return &ti.Columns[k]
+		}
+	}
+	return nil
+}
+
+func (ti *TableInfo) ColumnNames() []string {
+	var Names []string
+	for _, v := range ti.Columns {
+		Names = append(Names, v.Name)
+	}
+	return Names
+}
+
+func splitTableName(Table string) (Schema string, Name string) {
+	if Dot := strings.Index(Table, "."); Dot > 0 {
+		return Table[:Dot], Table[Dot+1:]
+	}
+	return "", Table
+}
+
+func describeTableMysql(ctx context.Context, Db *sql.DB, Table string) (*TableInfo, error) {
+	Schema, Name := splitTableName(Table)
+	Ti := &TableInfo{Schema: Schema, Name: Name, UniqueKeys: make(map[string][]string)}
+	SchemaExpr := "DATABASE()"
+	Args := []interface{}{Name}
+	if Schema != "" {
+		SchemaExpr = "?"
+		Args = []interface{}{Schema, Name}
+	}
+	Rows, err := Db.QueryContext(ctx, `SELECT column_name, column_type, is_nullable = 'YES', column_default
+		FROM information_schema.columns WHERE table_schema = `+SchemaExpr+` AND table_name = ?
+		ORDER BY ordinal_position`, Args...)
+	if err != nil {
+		return nil, err
+	}
+	for Rows.Next() {
+		var Col ColumnInfo
+		if err = Rows.Scan(&Col.Name, &Col.Type, &Col.Nullable, &Col.Default); err != nil {
+			Rows.Close()
+			return nil, err
+		}
+		Ti.Columns = append(Ti.Columns, Col)
+	}
+	Rows.Close()
+	if err = Rows.Err(); err != nil {
+		return nil, err
+	}
+	Rows, err = Db.QueryContext(ctx, `SELECT index_name, column_name
+		FROM information_schema.statistics WHERE table_schema = `+SchemaExpr+` AND table_name = ? AND non_unique = 0
+		ORDER BY index_name, seq_in_index`, Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer Rows.Close()
+	for Rows.Next() {
+		var Index, Col string
+		if err = Rows.Scan(&Index, &Col); err != nil {
+			return nil, err
+		}
+		Ti.UniqueKeys[Index] = append(Ti.UniqueKeys[Index], Col)
+		if Index == "PRIMARY" {
+			Ti.PrimaryKey = append(Ti.PrimaryKey, Col)
+		}
+	}
+	return Ti, Rows.Err()
+}
+
+func describeTablePg(ctx context.Context, Db *sql.DB, Table string) (*TableInfo, error) {
+	Schema, Name := splitTableName(Table)
+	Ti := &TableInfo{Schema: Schema, Name: Name, UniqueKeys: make(map[string][]string)}
+	Rel := quoteIdentFor(DbTypePostgres, Table)
+	Rows, err := Db.QueryContext(ctx, `SELECT a.attname, format_type(a.atttypid, a.atttypmod), NOT a.attnotnull,
+		pg_get_expr(d.adbin, d.adrelid)
+		FROM pg_attribute a LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, Rel)
+	if err != nil {
+		return nil, err
+	}
+	for Rows.Next() {
+		var Col ColumnInfo
+		if err = Rows.Scan(&Col.Name, &Col.Type, &Col.Nullable, &Col.Default); err != nil {
+			Rows.Close()
+			return nil, err
+		}
+		Ti.Columns = append(Ti.Columns, Col)
+	}
+	Rows.Close()
+	if err = Rows.Err(); err != nil {
+		return nil, err
+	}
+	Rows, err = Db.QueryContext(ctx, `SELECT c.relname, i.indisprimary, a.attname
+		FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN LATERAL unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		WHERE i.indrelid = to_regclass($1) AND i.indisunique
+		ORDER BY c.relname, k.ord`, Rel)
+	if err != nil {
+		return nil, err
+	}
+	defer Rows.Close()
+	for Rows.Next() {
+		var Index, Col string
+		var Primary bool
+		if err = Rows.Scan(&Index, &Primary, &Col); err != nil {
+			return nil, err
+		}
+		Ti.UniqueKeys[Index] = append(Ti.UniqueKeys[Index], Col)
+		if Primary {
+			Ti.PrimaryKey = append(Ti.PrimaryKey, Col)
+		}
+	}
+	return Ti, Rows.Err()
+}
+
+func describeTable(ctx context.Context, Db *sql.DB, Type DbType, Table string) (*TableInfo, error) {
+	var Ti *TableInfo
+	var err error
+	switch Type {
+	case DbTypeMysql:
+		Ti, err = describeTableMysql(ctx, Db, Table)
+	case DbTypePostgres:
+		Ti, err = describeTablePg(ctx, Db, Table)
+	default:
+		return nil, fmt.Errorf("can't describe table '%s'; unknown database type", Table)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't describe table '%s': %w", Table, err)
+	}
+	if len(Ti.Columns) == 0 {
+		return nil, fmt.Errorf("table '%s' doesn't exist", Table)
+	}
+	for _, v := range Ti.PrimaryKey {
+		Ti.Column(v).PrimaryKey = true
+	}
+	return Ti, nil
+}
+
+func (dbh *DbHandle) DescribeTable(Table string) (*TableInfo, error) {
+	return dbh.DescribeTableContext(nil, Table)
+}
+
+func (dbh *DbHandle) DescribeTableContext(ctx context.Context, Table string) (*TableInfo, error) {
+	ctx, cancel := dbh.statementContext(ctx)
+	defer cancel()
+	return describeTable(ctx, dbh.DB, dbh.dbtype, Table)
+}
+
+// ListTables returns the base tables of the current database (MySQL) or of the
+// current schema (Postgres), sorted.
+func (dbh *DbHandle) ListTables() ([]string, error) {
+	ctx, cancel := dbh.statementContext(nil)
+	defer cancel()
+	var Query string
+	switch dbh.dbtype {
+	case DbTypeMysql:
+		Query = `SELECT table_name FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'`
+	case DbTypePostgres:
+		Query = `SELECT tablename FROM pg_catalog.pg_tables WHERE schemaname = current_schema()`
+	default:
+		return nil, fmt.Errorf("can't list tables of %s; unknown database type", dbh.Identifier())
+	}
+	Rows, err := dbh.DB.QueryContext(ctx, Query)
+	if err != nil {
+		return nil, fmt.Errorf("listing tables of %s: %w", dbh.Identifier(), dbErrorOrNil(err))
+	}
+	defer Rows.Close()
+	var Tables []string
+	for Rows.Next() {
+		var Name string
+		if err = Rows.Scan(&Name); err != nil {
+			return nil, err
+		}
+		Tables = append(Tables, Name)
+	}
+	sort.Strings(Tables)
+	return Tables, Rows.Err()
+}
+
+// StructColumns lists the columns a struct would scan from, by the same rules
+// as ScanStructs; handy for building a SchemaExpectation.
+func StructColumns(Row interface{}) []string {
+	Type := reflect.TypeOf(Row)
+	for Type.Kind() == reflect.Ptr || Type.Kind() == reflect.Slice {
+		Type = Type.Elem()
+	}
+	var Cols []string
+	for k := range structFieldsOf(Type) {
+		Cols = append(Cols, k)
+	}
+	sort.Strings(Cols)
+	return Cols
+}
+
+// SchemaExpectation maps table names to the columns a program relies on.
+type SchemaExpectation map[string][]string
+
+// SchemaDrift returns one line per missing table or column.
+func (dbh *DbHandle) SchemaDrift(Expect SchemaExpectation) []string {
+	var Tables []string
+	for k := range Expect {
+		Tables = append(Tables, k)
+	}
+	sort.Strings(Tables)
+	var Problems []string
+	for _, Table := range Tables {
+		Ti, err := dbh.DescribeTable(Table)
+		if err != nil {
+			Problems = append(Problems, err.Error())
+			continue
+		}
+		for _, Col := range Expect[Table] {
+			if Ti.Column(Col) == nil {
+				Problems = append(Problems, fmt.Sprintf("table '%s' has no column '%s'", Table, Col))
+			}
+		}
+	}
+	return Problems
+}
+
+func (dbh *DbHandle) ValidateSchemaOrDie(Expect SchemaExpectation) {
+	Problems := dbh.SchemaDrift(Expect)
+	for _, v := range Problems {
+		log.Critf("Schema drift on %s: %s\n", dbh.Identifier(), v)
+	}
+	if len(Problems) > 0 {
+		log.Printf("Exiting due to schema drift (see above)\n")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,185 @@
+package shared
+
+import (
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Per-handle statement instrumentation. Every Exec/Query/QueryRow through a Stmt is
+timed and counted against its SQL text. Rows are rows affected for Exec, and rows
+scanned for the struct scanners; plain Query callers read their own rows, so we
+can't count those. Anything slower than SlowQuery gets logged, with the argument
+values redacted down to their types.
+*/
+
+type QueryStat struct {
+	Sql     string
+	Calls   int64
+	Errors  int64
+	Slow    int64
+	Rows    int64
+	Total   time.Duration
+	Max     time.Duration
+	LastErr string
+
+	CacheHits   int64 // Served by the result cache, without running
+	CacheMisses int64
+}
+
+type dbStats struct {
+	lock    sync.Mutex
+	queries map[string]*QueryStat
+	totals  QueryStat
+}
+
+func (dbh *DbHandle) SetSlowQuery(Threshold time.Duration) *DbHandle {
+	dbh.SlowQuery = Threshold
+	return dbh
+}
+
+func redactArgs(args []interface{}) string {
+	var Buf []string
+	for _, v := range args {
+		switch Val := v.(type) {
+		case nil:
+			Buf = append(Buf, "NULL")
+		case string:
+			Buf = append(Buf, fmt.Sprintf("string(%d)", len(Val)))
+		case []byte:
+			Buf = append(Buf, fmt.Sprintf("[]byte(%d)", len(Val)))
+		default:
+			Buf = append(Buf, fmt.Sprintf("%T", v))
+		}
+	}
+	return "[" + strings.Join(Buf, ", ") + "]"
+}
+
+func (st *QueryStat) add(Elapsed time.Duration, Rows int64, err error, Slow bool) {
+	st.Calls++
+	st.Total += Elapsed
+	if Elapsed > st.Max {
+		st.Max = Elapsed
+	}
+	if Rows > 0 {
+		st.Rows += Rows
+	}
+	if err != nil {
+		st.Errors++
+		st.LastErr = err.Error()
+	}
+	if Slow {
+		st.Slow++
+	}
+}
+
+func (sth *Stmt) record(Started time.Time, Rows int64, err error, args []interface{}) {
+	dbh := sth.dbh
+	Elapsed := time.Since(Started)
+	Slow := dbh.SlowQuery > 0 && Elapsed >= dbh.SlowQuery
+	if Slow {
+		log.Warnf("Slow query (%s) on '%s': %s args %s\n",
+			Elapsed, dbh.Identifier(), sth.Identify(), redactArgs(args))
+	}
+	dbh.stats.lock.Lock()
+	defer dbh.stats.lock.Unlock()
+	if dbh.stats.queries == nil {
+		dbh.stats.queries = make(map[string]*QueryStat)
+	}
+	Stat, found := dbh.stats.queries[sth.sql]
+	if !found {
+		Stat = &QueryStat{Sql: sth.sql}
+		dbh.stats.queries[sth.sql] = Stat
+	}
+	Stat.add(Elapsed, Rows, err, Slow)
+	dbh.stats.totals.add(Elapsed, Rows, err, Slow)
+}
+
+func (sth *Stmt) recordRows(Rows int64) {
+	sth.dbh.stats.lock.Lock()
+	defer sth.dbh.stats.lock.Unlock()
+	if Stat, found := sth.dbh.stats.queries[sth.sql]; found {
+		Stat.Rows += Rows
+	}
+	sth.dbh.stats.totals.Rows += Rows
+}
+
+// QueryStats returns a snapshot of the per-statement counters, slowest total first.
+func (dbh *DbHandle) QueryStats() []QueryStat {
+	dbh.stats.lock.Lock()
+	var Stats []QueryStat
+	for _, v := range dbh.stats.queries {
+		Stats = append(Stats, *v)
+	}
+	dbh.stats.lock.Unlock()
+	sort.Slice(Stats, func(i, j int) bool {
+		return Stats[i].Total > Stats[j].Total
+	})
+	return Stats
+}
+
+func (dbh *DbHandle) QueryStatTotals() QueryStat {
+	dbh.stats.lock.Lock()
+	defer dbh.stats.lock.Unlock()
+	return dbh.stats.totals
+}
+
+func (st QueryStat) Json() sjson.JSON {
+	Caw := sjson.NewJson()
+	Caw["sql"] = st.Sql
+	Caw["calls"] = st.Calls
+	Caw["errors"] = st.Errors
+	Caw["slow"] = st.Slow
+	Caw["rows"] = st.Rows
+	Caw["total_ms"] = st.Total.Milliseconds()
+	Caw["max_ms"] = st.Max.Milliseconds()
+	if st.Calls > 0 {
+		Caw["avg_ms"] = float64(st.Total.Microseconds()) / float64(st.Calls) / 1000
+	}
+	if st.LastErr != "" {
+		Caw["last_error"] = st.LastErr
+	}
+	if st.CacheHits+st.CacheMisses > 0 {
+		Caw["cache_hits"] = st.CacheHits
+		Caw["cache_misses"] = st.CacheMisses
+	}
+	return Caw
+}
+
+func (dbh *DbHandle) QueryStatsJson() sjson.JSON {
+	Caw := sjson.NewJson()
+	Caw["handle"] = dbh.Identifier()
+	Caw["slow_threshold_ms"] = dbh.SlowQuery.Milliseconds()
+	Caw["totals"] = dbh.QueryStatTotals().Json()
+	Queries := sjson.NewJsonArray()
+	for _, v := range dbh.QueryStats() {
+		Queries = append(Queries, v.Json())
+	}
+	Caw["queries"] = Queries
+	return Caw
+}
+
+func (dbh *DbHandle) QueryStatsHtml() string {
+	Totals := dbh.QueryStatTotals()
+	Buf := fmt.Sprintf("<h3>Query Stats for %s</h3><table border=\"1\">\n", html.EscapeString(dbh.Identifier()))
+	Buf += "<tr><th>SQL</th><th>Calls</th><th>Errors</th><th>Slow</th><th>Rows</th><th>Total</th><th>Avg</th><th>Max</th><th>Cache hits</th></tr>\n"
+	Row := func(Label string, st QueryStat) string {
+		var Avg time.Duration
+		if st.Calls > 0 {
+			Avg = st.Total / time.Duration(st.Calls)
+		}
+		return fmt.Sprintf(`<tr><td>%s</td><td align="right">%d</td><td align="right">%d</td><td align="right">%d</td><td align="right">%d</td><td align="right">%s</td><td align="right">%s</td><td align="right">%s</td><td align="right">%d</td></tr>
+`, Label, st.Calls, st.Errors, st.Slow, st.Rows, st.Total, Avg, st.Max, st.CacheHits)
+	}
+	for _, v := range dbh.QueryStats() {
+		Buf += Row("<code>"+html.EscapeString(v.Sql)+"</code>", v)
+	}
+	Buf += Row("<b>All statements</b>", Totals)
+	Buf += "</table>\n"
+	return Buf
+}
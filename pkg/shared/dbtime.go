@@ -0,0 +1,164 @@
+package shared
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"strings"
+	"time"
+)
+
+/*
+Time codec. MySQL DATETIME carries no zone, so its values mean whatever zone
+the database was written in; the ini's timezone= names it (Local if unset), and
+the MySQL DSN's loc follows it so the driver reads and writes DATETIMEs in that
+zone. Postgres sessions get the same zone, which only changes how timestamptz
+is rendered as text; the instants are the same either way. Postgres timestamp
+and date, like DATETIME, are wall clocks, and are read as such in the zone.
+
+MySQL's zero date ('0000-00-00 00:00:00') has no time.Time equivalent, so it's
+decoded as nil like NULL unless KeepZero is set, in which case it comes back
+as the zero time.Time. A nil or zero time encodes as NULL.
+
+dbh.ScanRows hands the codec to sjson's ScanRowsWith, so date and time columns
+come back as time.Time in the database's zone rather than as driver-dependent
+strings. sjson's own ScanRows uses sjson.DefaultTimeCodec, which is nil unless
+the program sets it (sjson.DefaultTimeCodec = dbh.TimeCodec()). FormatMysqlTime
+is unchanged and zone-blind; the codec's Format is the zone-aware one.
+*/
+
+type DbTimeCodec struct {
+	Dialect  DbType
+	Location *time.Location
+	KeepZero bool
+}
+
+// Layouts with no zone are read in the codec's Location.
+var dbTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+func (dbh *DbHandle) TimeCodec() *DbTimeCodec {
+	Loc := dbh.TimeZone
+	if Loc == nil {
+		Loc = time.Local
+	}
+	return &DbTimeCodec{Dialect: dbh.dbtype, Location: Loc}
+}
+
+func (c *DbTimeCodec) location() *time.Location {
+	if c.Location == nil {
+		return time.Local
+	}
+	return c.Location
+}
+
+func isZeroDate(s string) bool {
+	return strings.HasPrefix(s, "0000-00-00")
+}
+
+// Parse reads a time as either database writes it, or as RFC3339. An empty
+// string or zero date gives nil.
+func (c *DbTimeCodec) Parse(s string) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || (isZeroDate(s) && !c.KeepZero) {
+		return nil, nil
+	}
+	if isZeroDate(s) {
+		return &time.Time{}, nil
+	}
+	for _, Layout := range dbTimeLayouts {
+		if Time, err := time.ParseInLocation(Layout, s, c.location()); err == nil {
+			Time = Time.In(c.location())
+			return &Time, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized time '%s'", s)
+}
+
+// Format writes t the way the database wants it as text; DATETIME has no zone,
+// so for MySQL it's converted to the codec's zone first.
+func (c *DbTimeCodec) Format(t time.Time) string {
+	if c.Dialect == DbTypePostgres {
+		return t.Format("2006-01-02 15:04:05.999999Z07:00")
+	}
+	return t.In(c.location()).Format("2006-01-02 15:04:05.999999")
+}
+
+// zoneless reports whether DbType is a Postgres type without a zone, which pq
+// hands back as its wall clock tagged UTC.
+func (c *DbTimeCodec) zoneless(DbType string) bool {
+	return c.Dialect == DbTypePostgres && (DbType == "TIMESTAMP" || DbType == "DATE")
+}
+
+// ScanTime implements sjson.TimeCodec. A zone-less Postgres value keeps its
+// wall clock, read in the codec's Location; converting it would shift it by
+// the zone's offset, and the shifted time would be wrong when bound back.
+func (c *DbTimeCodec) ScanTime(DbType string, Src interface{}) (interface{}, error) {
+	var Time *time.Time
+	var err error
+	switch Val := Src.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		if Val.IsZero() && !c.KeepZero {
+			return nil, nil
+		}
+		if c.zoneless(DbType) {
+			Val = time.Date(Val.Year(), Val.Month(), Val.Day(), Val.Hour(), Val.Minute(), Val.Second(),
+				Val.Nanosecond(), c.location())
+		} else {
+			Val = Val.In(c.location())
+		}
+		Time = &Val
+	case []byte:
+		Time, err = c.Parse(string(Val))
+	case string:
+		Time, err = c.Parse(Val)
+	default:
+		return nil, fmt.Errorf("can't read a time from %T", Src)
+	}
+	if err != nil || Time == nil {
+		return nil, err
+	}
+	return *Time, nil
+}
+
+// Scan reads a time column into a NullTime, decoding text and zero dates
+// as ScanTime does; a time.Time is taken to be an instant, as from timestamptz.
+func (c *DbTimeCodec) Scan(Src interface{}) (sql.NullTime, error) {
+	Val, err := c.ScanTime("", Src)
+	if err != nil || Val == nil {
+		return sql.NullTime{}, err
+	}
+	return sql.NullTime{Time: Val.(time.Time), Valid: true}, nil
+}
+
+// Value gives what to bind for t: NULL for the zero time, else the time in the
+// codec's zone.
+func (c *DbTimeCodec) Value(t time.Time) driver.Value {
+	if t.IsZero() {
+		return nil
+	}
+	return t.In(c.location())
+}
+
+// ScanRows reads Rows into JSON, decoding times with the handle's codec.
+func (dbh *DbHandle) ScanRows(Rows *sql.Rows) (sjson.JSONarray, error) {
+	var Result sjson.JSONarray
+	err := Result.ScanRowsWith(Rows, dbh.TimeCodec())
+	return Result, err
+}
+
+func (dbh *DbHandle) mysqlLocation() string {
+	return dbh.TimeCodec().location().String()
+}
+
+// localTimeCodec backs the older helpers, which always worked in Local.
+var localTimeCodec = &DbTimeCodec{Dialect: DbTypeMysql, Location: time.Local}
@@ -0,0 +1,159 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+/*
+Closure-based transactions. WithTx begins a transaction, hands it to Fn, and
+commits if Fn returns nil or rolls back if it returns an error or panics. Calling
+WithTx again with the transaction's Context(), or calling Tx.WithTx, nests the
+inner block inside a savepoint rather than a new transaction.
+
+The outermost block is retried as a whole under the handle's RetryPolicy, so Fn
+must not have side effects outside the database that can't stand repeating.
+
+Statements from Tx.Stmt keep their Invalidates tags; their Execs hold the
+invalidation until the outermost block commits, so nothing can re-cache the old
+rows in between.
+*/
+
+type Tx struct {
+	*sql.Tx
+	dbh     *DbHandle
+	ctx     context.Context
+	depth   int
+	pending *txInvalidations // Shared with nested blocks
+}
+
+// txInvalidations are the result cache tags to drop once the transaction commits.
+type txInvalidations struct {
+	lock sync.Mutex
+	tags []string
+}
+
+func (tx *Tx) invalidateOnCommit(Tags ...string) {
+	tx.pending.lock.Lock()
+	tx.pending.tags = append(tx.pending.tags, Tags...)
+	tx.pending.lock.Unlock()
+}
+
+func (tx *Tx) committed() {
+	tx.pending.lock.Lock()
+	Tags := tx.pending.tags
+	tx.pending.lock.Unlock()
+	if len(Tags) > 0 {
+		tx.dbh.InvalidateCacheTag(Tags...)
+	}
+}
+
+type txContextKey struct{}
+
+// TxFromContext returns the transaction a WithTx block is running in, if any.
+func TxFromContext(ctx context.Context) *Tx {
+	tx, _ := ctx.Value(txContextKey{}).(*Tx)
+	return tx
+}
+
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+func (tx *Tx) Handle() *DbHandle {
+	return tx.dbh
+}
+
+// Stmt returns a copy of sth bound to this transaction, keeping its
+// placeholder translation, argument order and Invalidates tags.
+func (tx *Tx) Stmt(sth *Stmt) *Stmt {
+	Bound := &Stmt{
+		dbh:         sth.dbh,
+		sql:         sth.sql,
+		argorder:    sth.argorder,
+		failure:     sth.prepErr(),
+		tx:          tx,
+		invalidates: sth.invalidates,
+	}
+	if Bound.failure == nil {
+		Bound.Stmt = tx.Tx.StmtContext(tx.ctx, sth.current())
+	}
+	return Bound
+}
+
+func (tx *Tx) Prepare(sql string) *Stmt {
+	stmt, err := tx.Tx.PrepareContext(tx.ctx, sql)
+	log.Debugf("DB '%s': Prepare'ing query '%s' in transaction\n", tx.dbh.Identifier(), sql)
+	return &Stmt{
+		Stmt:    stmt,
+		dbh:     tx.dbh,
+		sql:     sql,
+		failure: err,
+		tx:      tx,
+	}
+}
+
+func (tx *Tx) TransPrep(sql string) *Stmt {
+	return tx.Prepare(tx.dbh.Translate(sql))
+}
+
+func runTxFunc(tx *Tx, Fn func(*Tx) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Critf("Panic inside transaction on '%s': %v\n%s\n", tx.dbh.Identifier(), r, debug.Stack())
+			err = fmt.Errorf("panic inside transaction: %v", r)
+		}
+	}()
+	return Fn(tx)
+}
+
+func (dbh *DbHandle) WithTx(ctx context.Context, opts *sql.TxOptions, Fn func(*Tx) error) error {
+	if ctx == nil {
+		ctx = dbh.baseContext()
+	}
+	if Outer := TxFromContext(ctx); Outer != nil && Outer.dbh == dbh {
+		return Outer.WithTx(Fn)
+	}
+	return dbErrorOrNil(dbh.withRetry(ctx, "transaction", false, func() error {
+		sqlTx, err := dbh.DB.BeginTx(ctx, opts)
+		if err != nil {
+			return err
+		}
+		tx := &Tx{Tx: sqlTx, dbh: dbh, pending: &txInvalidations{}}
+		tx.ctx = context.WithValue(ctx, txContextKey{}, tx)
+		err = runTxFunc(tx, Fn)
+		if err != nil {
+			if rbErr := sqlTx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				log.Errorf("Rollback on '%s' failed: %s\n", dbh.Identifier(), rbErr)
+			}
+			return err
+		}
+		if err = sqlTx.Commit(); err == nil {
+			tx.committed()
+		}
+		return err
+	}))
+}
+
+// WithTx runs Fn inside a savepoint of the current transaction; an error or
+// panic rolls back to the savepoint and leaves the outer transaction usable.
+func (tx *Tx) WithTx(Fn func(*Tx) error) error {
+	Inner := &Tx{Tx: tx.Tx, dbh: tx.dbh, depth: tx.depth + 1, pending: tx.pending}
+	Inner.ctx = context.WithValue(tx.ctx, txContextKey{}, Inner)
+	Savepoint := fmt.Sprintf("sp_%d", Inner.depth)
+	if _, err := tx.Tx.ExecContext(tx.ctx, "SAVEPOINT "+Savepoint); err != nil {
+		return dbErrorOrNil(err)
+	}
+	err := runTxFunc(Inner, Fn)
+	if err != nil {
+		if _, rbErr := tx.Tx.ExecContext(tx.ctx, "ROLLBACK TO SAVEPOINT "+Savepoint); rbErr != nil {
+			log.Errorf("Rollback to savepoint %s on '%s' failed: %s\n", Savepoint, tx.dbh.Identifier(), rbErr)
+		}
+		return dbErrorOrNil(err)
+	}
+	_, err = tx.Tx.ExecContext(tx.ctx, "RELEASE SAVEPOINT "+Savepoint)
+	return dbErrorOrNil(err)
+}
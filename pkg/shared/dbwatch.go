@@ -0,0 +1,336 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Table change watcher. WatchTable polls a table for rows past its high-water
+mark and sends each as an event on C, oldest first. The mark is either an
+ever-increasing id column (ById; every row is an insert) or an updated
+timestamp with the id breaking ties, so rows sharing a timestamp aren't skipped
+or repeated. With CreatedColumn set, a row whose created and updated agree is
+reported as an insert rather than an update.
+
+The mark advances only once a row's event has been taken off C, and if Marks
+is set it's saved there after every batch, so a restarted watcher resumes where
+the last one stopped. Without a saved mark it starts from the current end of
+the table, or the beginning with FromStart.
+
+A timestamp mark can miss a row whose transaction commits after a later one
+has already been read; leave it some slack, or watch by id.
+*/
+
+const (
+	DefaultWatchInterval  = 5 * time.Second
+	DefaultWatchBatch     = 1000
+	DefaultWatchMarkTable = "db_watch_marks"
+
+	TableInsert = "insert"
+	TableUpdate = "update"
+)
+
+type TableWatchOptions struct {
+	Column        string // Updated timestamp; "updated" if empty. Unused with ById.
+	IdColumn      string // "id" if empty
+	ById          bool
+	CreatedColumn string
+	Interval      time.Duration
+	Batch         int
+	FromStart     bool
+	Name          string // Key for the saved mark; the table name if empty
+	Marks         WatchMarkStore
+}
+
+type TableEvent struct {
+	Table string
+	Op    string // TableInsert or TableUpdate
+	Row   sjson.JSON
+}
+
+type WatchMark struct {
+	Value interface{} // Of the timestamp column; nil with ById
+	Id    int64
+}
+
+type WatchMarkStore interface {
+	LoadMark(ctx context.Context, Name string) (*WatchMark, error)
+	SaveMark(ctx context.Context, Name string, Mark *WatchMark) error
+}
+
+type TableWatcher struct {
+	C        <-chan *TableEvent
+	dbh      *DbHandle
+	Table    string
+	opts     TableWatchOptions
+	out      chan *TableEvent
+	mark     *WatchMark
+	markLock sync.Mutex
+	done     chan struct{}
+}
+
+func (dbh *DbHandle) WatchTable(ctx context.Context, Table string, Opts *TableWatchOptions) (*TableWatcher, error) {
+	if ctx == nil {
+		ctx = dbh.baseContext()
+	}
+	Out := make(chan *TableEvent)
+	w := &TableWatcher{C: Out, dbh: dbh, Table: Table, out: Out, done: make(chan struct{})}
+	if Opts != nil {
+		w.opts = *Opts
+	}
+	if w.opts.Column == "" {
+		w.opts.Column = "updated"
+	}
+	if w.opts.IdColumn == "" {
+		w.opts.IdColumn = "id"
+	}
+	if w.opts.Interval <= 0 {
+		w.opts.Interval = DefaultWatchInterval
+	}
+	if w.opts.Batch <= 0 {
+		w.opts.Batch = DefaultWatchBatch
+	}
+	if w.opts.Name == "" {
+		w.opts.Name = Table
+	}
+	var err error
+	if w.opts.Marks != nil {
+		if w.mark, err = w.opts.Marks.LoadMark(ctx, w.opts.Name); err != nil {
+			return nil, fmt.Errorf("loading mark for watch '%s': %w", w.opts.Name, err)
+		}
+	}
+	if w.mark == nil && !w.opts.FromStart {
+		if w.mark, err = w.currentEnd(ctx); err != nil {
+			return nil, fmt.Errorf("finding end of %s: %w", Table, err)
+		}
+	}
+	go w.run(ctx)
+	return w, nil
+}
+
+// Mark is how far the watcher has got; nil if nothing has been seen yet.
+func (w *TableWatcher) Mark() *WatchMark {
+	w.markLock.Lock()
+	defer w.markLock.Unlock()
+	return w.mark
+}
+
+// Done is closed, as is C, once the watcher stops for ctx.
+func (w *TableWatcher) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *TableWatcher) currentEnd(ctx context.Context) (*WatchMark, error) {
+	Id := w.dbh.QuoteIdent(w.opts.IdColumn)
+	Query := fmt.Sprintf("SELECT %s FROM %s ORDER BY %s DESC LIMIT 1", Id, w.dbh.QuoteIdent(w.Table), Id)
+	if !w.opts.ById {
+		Col := w.dbh.QuoteIdent(w.opts.Column)
+		Query = fmt.Sprintf("SELECT %s, %s FROM %s ORDER BY %s DESC, %s DESC LIMIT 1", Id, Col, w.dbh.QuoteIdent(w.Table), Col, Id)
+	}
+	ctx, cancel := w.dbh.statementContext(ctx)
+	defer cancel()
+	Mark := &WatchMark{}
+	var err error
+	if w.opts.ById {
+		err = w.dbh.DB.QueryRowContext(ctx, Query).Scan(&Mark.Id)
+	} else {
+		err = w.dbh.DB.QueryRowContext(ctx, Query).Scan(&Mark.Id, &Mark.Value)
+	}
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return Mark, dbErrorOrNil(err)
+}
+
+func (w *TableWatcher) query() (string, []interface{}) {
+	Id := w.dbh.QuoteIdent(w.opts.IdColumn)
+	Col := w.dbh.QuoteIdent(w.opts.Column)
+	Table := w.dbh.QuoteIdent(w.Table)
+	var Where, Order string
+	var Args []interface{}
+	if w.opts.ById {
+		Order = Id
+		if w.mark != nil {
+			Where = fmt.Sprintf("WHERE %s > ?", Id)
+			Args = []interface{}{w.mark.Id}
+		}
+	} else {
+		Order = Col + ", " + Id
+		if w.mark != nil {
+			Where = fmt.Sprintf("WHERE %s > ? OR (%s = ? AND %s > ?)", Col, Col, Id)
+			Args = []interface{}{w.mark.Value, w.mark.Value, w.mark.Id}
+		}
+	}
+	return bindPlaceholders(w.dbh.dbtype, fmt.Sprintf("SELECT * FROM %s %s ORDER BY %s LIMIT %d",
+		Table, Where, Order, w.opts.Batch)), Args
+}
+
+// poll sends the next batch and reports whether it was a full one.
+func (w *TableWatcher) poll(ctx context.Context) (bool, error) {
+	Query, Args := w.query()
+	qctx, cancel := w.dbh.statementContext(ctx)
+	Rows, err := w.dbh.DB.QueryContext(qctx, Query, Args...)
+	if err != nil {
+		cancel()
+		return false, dbErrorOrNil(err)
+	}
+	Batch, err := w.dbh.ScanRows(Rows)
+	Rows.Close()
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	for _, Row := range Batch {
+		Id, err := watchInt64(Row[w.opts.IdColumn])
+		if err != nil {
+			return false, fmt.Errorf("column %s: %w", w.opts.IdColumn, err)
+		}
+		Event := &TableEvent{Table: w.Table, Op: TableInsert, Row: Row}
+		Mark := &WatchMark{Id: Id}
+		if !w.opts.ById {
+			Mark.Value = watchMarkValue(Row[w.opts.Column])
+			if w.opts.CreatedColumn == "" || fmt.Sprint(Row[w.opts.CreatedColumn]) != fmt.Sprint(Row[w.opts.Column]) {
+				Event.Op = TableUpdate
+			}
+		}
+		select {
+		case w.out <- Event:
+			w.markLock.Lock()
+			w.mark = Mark
+			w.markLock.Unlock()
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	if len(Batch) > 0 && w.opts.Marks != nil {
+		if err = w.opts.Marks.SaveMark(ctx, w.opts.Name, w.mark); err != nil {
+			log.Errorf("Couldn't save mark for watch '%s': %s\n", w.opts.Name, err)
+		}
+	}
+	return len(Batch) == w.opts.Batch, nil
+}
+
+func (w *TableWatcher) run(ctx context.Context) {
+	defer close(w.done)
+	defer close(w.out)
+	for {
+		More, err := w.poll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Watching %s on %s: %s\n", w.Table, w.dbh.Identifier(), err)
+		}
+		if More {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.opts.Interval):
+		}
+	}
+}
+
+// watchMarkValue turns a timestamp ScanRows left as text back into a time, so
+// it binds as one.
+func watchMarkValue(v interface{}) interface{} {
+	if Str, isStr := v.(string); isStr {
+		if Time, err := time.Parse(time.RFC3339Nano, Str); err == nil {
+			return Time
+		}
+	}
+	return v
+}
+
+func watchInt64(v interface{}) (int64, error) {
+	switch Val := v.(type) {
+	case int64:
+		return Val, nil
+	case int:
+		return int64(Val), nil
+	case int32:
+		return int64(Val), nil
+	case float64:
+		return int64(Val), nil
+	case string:
+		return strconv.ParseInt(Val, 10, 64)
+	}
+	return 0, fmt.Errorf("can't use %T as a watch id", v)
+}
+
+type dbWatchMarks struct {
+	dbh   *DbHandle
+	Table string
+}
+
+type watchMarkJson struct {
+	Value  interface{} `json:"value"`
+	IsTime bool        `json:"is_time,omitempty"`
+	Id     int64       `json:"id"`
+}
+
+// WatchMarkTableSql returns the statement creating a mark table.
+func WatchMarkTableSql(Table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(191) NOT NULL PRIMARY KEY, mark TEXT NOT NULL, updated TIMESTAMP NOT NULL)", Table)
+}
+
+// WatchMarks keeps watch marks in a table on this handle (see WatchMarkTableSql).
+func (dbh *DbHandle) WatchMarks(Table string) WatchMarkStore {
+	if Table == "" {
+		Table = DefaultWatchMarkTable
+	}
+	return &dbWatchMarks{dbh: dbh, Table: Table}
+}
+
+func (m *dbWatchMarks) LoadMark(ctx context.Context, Name string) (*WatchMark, error) {
+	ctx, cancel := m.dbh.statementContext(ctx)
+	defer cancel()
+	var Stored string
+	err := m.dbh.DB.QueryRowContext(ctx, bindPlaceholders(m.dbh.dbtype,
+		fmt.Sprintf("SELECT mark FROM %s WHERE name=?", m.Table)), Name).Scan(&Stored)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbErrorOrNil(err)
+	}
+	var Decoded watchMarkJson
+	if err = json.Unmarshal([]byte(Stored), &Decoded); err != nil {
+		return nil, fmt.Errorf("mark '%s' is corrupt: %w", Name, err)
+	}
+	Mark := &WatchMark{Value: Decoded.Value, Id: Decoded.Id}
+	if Decoded.IsTime {
+		if Mark.Value, err = time.Parse(time.RFC3339Nano, fmt.Sprint(Decoded.Value)); err != nil {
+			return nil, fmt.Errorf("mark '%s' has a bad time: %w", Name, err)
+		}
+	}
+	return Mark, nil
+}
+
+func (m *dbWatchMarks) SaveMark(ctx context.Context, Name string, Mark *WatchMark) error {
+	Encoded := watchMarkJson{Value: Mark.Value, Id: Mark.Id}
+	if Time, isTime := Mark.Value.(time.Time); isTime {
+		Encoded.Value, Encoded.IsTime = Time.Format(time.RFC3339Nano), true
+	}
+	Bytes, err := json.Marshal(Encoded)
+	if err != nil {
+		return err
+	}
+	Query := "INSERT INTO %s (name, mark, updated) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE mark=VALUES(mark), updated=VALUES(updated)"
+	if m.dbh.dbtype == DbTypePostgres {
+		Query = "INSERT INTO %s (name, mark, updated) VALUES (?, ?, ?) ON CONFLICT (name) DO UPDATE SET mark=EXCLUDED.mark, updated=EXCLUDED.updated"
+	}
+	ctx, cancel := m.dbh.statementContext(ctx)
+	defer cancel()
+	_, err = m.dbh.DB.ExecContext(ctx, bindPlaceholders(m.dbh.dbtype, fmt.Sprintf(Query, m.Table)),
+		Name, string(Bytes), time.Now().UTC())
+	return dbErrorOrNil(err)
+}
@@ -0,0 +1,44 @@
+package shared
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A zone-less Postgres timestamp read in a non-UTC zone must come back, and
+// be bound as the next mark, with its wall clock unchanged.
+func TestWatchTableZoneless(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Updated := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	Fake.On(`^SELECT \* FROM "events"  ORDER BY`).Once().Return([]string{"id", "updated"},
+		[]interface{}{int64(1), Updated})
+	dbh := Fake.Handle()
+	defer dbh.Close()
+	dbh.TimeZone = time.FixedZone("EST", -5*60*60)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := dbh.WatchTable(ctx, "events", &TableWatchOptions{FromStart: true, Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("WatchTable: %s", err)
+	}
+	Event := <-w.C
+	Got, isTime := Event.Row["updated"].(time.Time)
+	if !isTime || Got.Format("2006-01-02 15:04:05") != "2024-03-01 10:00:00" || Got.Location() != dbh.TimeZone {
+		t.Errorf("row's updated is %v", Event.Row["updated"])
+	}
+	for Deadline := time.Now().Add(time.Second); time.Now().Before(Deadline); time.Sleep(time.Millisecond) {
+		if len(Fake.CallsMatching(`WHERE`)) > 0 {
+			break
+		}
+	}
+	Calls := Fake.CallsMatching(`WHERE`)
+	if len(Calls) == 0 {
+		t.Fatalf("watcher never polled past its mark")
+	}
+	Mark, isTime := Calls[0].Args[0].(time.Time)
+	if !isTime || Mark.Format("2006-01-02 15:04:05") != "2024-03-01 10:00:00" {
+		t.Errorf("mark was bound as %v", Calls[0].Args[0])
+	}
+}
@@ -8,6 +8,22 @@ import (
 	"time"
 )
 
+// Changes to the liveconfig table are announced on this channel, with the
+// label as payload, by the trigger in LiveConfigTriggerSql.
+const LiveConfigChannel = "liveconfig"
+
+const LiveConfigResync = 5 * time.Minute
+
+const LiveConfigTriggerSql = `CREATE OR REPLACE FUNCTION liveconfig_notify() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('liveconfig', NEW.label);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS liveconfig_notify ON liveconfig;
+CREATE TRIGGER liveconfig_notify AFTER INSERT OR UPDATE ON liveconfig
+	FOR EACH ROW EXECUTE PROCEDURE liveconfig_notify();`
+
 type LiveConfig struct {
 	db  *DbHandle
 	dbq struct {
@@ -56,8 +72,10 @@ func (Lc *LiveConfig) KeyList() sjson.JSONarray {
 		log.Errorf("DB failure pulling live config for API: %s\n", err)
 		return nil
 	}
-	Json := sjson.NewJsonArray()
-	Json.ScanRows(Res)
+	Json, err := Lc.db.ScanRows(Res)
+	if err != nil {
+		log.Errorf("Failed to read live config for API: %s\n", err)
+	}
 	return Json
 }
 
@@ -80,46 +98,101 @@ func (Lc *LiveConfig) FinishLoad() {
 	log.Printf("Initial load of liveconfig done.\n")
 }
 
+// WatchConfigs keeps the bound keys in step with the liveconfig table. On
+// Postgres it listens for LiveConfigChannel (see LiveConfigTriggerSql) and
+// reloads as soon as a row changes, re-reading everything every
+// LiveConfigResync in case a notification went missing; elsewhere, or if the
+// listen fails, it polls every delay.
 func (Lc *LiveConfig) WatchConfigs(delay time.Duration) {
-	var Pulses int
+	if Lc.db.DbType() == DbTypePostgres {
+		Listener, err := Lc.db.Listen(LiveConfigChannel)
+		if err == nil {
+			Lc.watchPushed(Listener, delay)
+		} else {
+			log.Warnf("Can't listen for liveconfig changes, polling instead: %s\n", err)
+		}
+	}
 	for true {
-		log.Debugf("Config loader thread %d starting\n", Pulses)
-		Dv, err := Lc.dbq.CheckLiveConfig.Query()
-		if err != nil {
+		log.Debugf("Config loader thread %d starting\n", Lc.Pulse)
+		if err := Lc.checkConfigs(); err != nil {
 			log.Fatalf("Failed to pull data versions: %s\n", err)
 		}
-		for Dv.Next() {
-			var (
-				Label   string
-				Updated string
-				Content sql.NullString
-			)
-			err = Dv.Scan(&Label, &Updated, &Content)
-			if err != nil {
-				log.Errorf("Failed to scan liveconfig: %s\n", err)
-				continue
+		Lc.Pulse++
+		time.Sleep(delay)
+	}
+}
+
+func (Lc *LiveConfig) watchPushed(Listener *DbListener, delay time.Duration) {
+	defer Listener.Close()
+	Resync := LiveConfigResync
+	if delay > Resync {
+		Resync = delay
+	}
+	for true {
+		if err := Lc.checkConfigs(); err != nil {
+			log.Errorf("Failed to pull data versions: %s\n", err)
+		}
+		Lc.Pulse++
+		select {
+		case Note, ok := <-Listener.C:
+			if !ok {
+				return
 			}
-			Lck := Lc.KeyRef(Label)
-			if Lck == nil {
-				continue
+			if Note.Reconnected {
+				log.Printf("Liveconfig listener reconnected; re-reading everything.\n")
+			} else {
+				log.Debugf("Liveconfig notified of change to '%s'\n", Note.Payload)
 			}
-			if Lck.Updated != Updated {
-				Res := Lc.dbq.GetLiveConfig.QueryRow(Label)
-				var Value string
-				err = Res.Scan(&Value)
-				if err != nil {
-					log.Errorf("DB error loading liveconfig string value '%s': %s\n", Label, err)
-					continue
-				}
-				log.Printf("%s cached is %s, db is %s\n",
-					Label, Lck.Updated, Updated)
-				Lck.Update(Content.String)
-				Lck.Updated = Updated
+		case <-time.After(Resync):
+		}
+	}
+}
+
+func (Lc *LiveConfig) checkConfigs() error {
+	Dv, err := Lc.dbq.CheckLiveConfig.Query()
+	if err != nil {
+		return err
+	}
+	defer Dv.Close()
+	for Dv.Next() {
+		var (
+			Label   string
+			Updated string
+			Content sql.NullString
+		)
+		err = Dv.Scan(&Label, &Updated, &Content)
+		if err != nil {
+			log.Errorf("Failed to scan liveconfig: %s\n", err)
+			continue
+		}
+		Lck := Lc.KeyRef(Label)
+		if Lck == nil {
+			continue
+		}
+		if Lck.Updated != Updated {
+			Res := Lc.dbq.GetLiveConfig.QueryRow(Label)
+			var Value string
+			err = Res.Scan(&Value)
+			if err != nil {
+				log.Errorf("DB error loading liveconfig string value '%s': %s\n", Label, err)
+				continue
 			}
+			log.Printf("%s cached is %s, db is %s\n",
+				Label, Lck.Updated, Updated)
+			Lck.Update(Content.String)
+			Lck.Updated = Updated
 		}
-		Lc.Pulse++
-		time.Sleep(delay)
 	}
+	return Dv.Err()
+}
+
+// InstallNotifyTrigger creates the trigger which WatchConfigs listens for.
+func (Lc *LiveConfig) InstallNotifyTrigger() error {
+	if Lc.db.DbType() != DbTypePostgres {
+		return fmt.Errorf("liveconfig notifications need Postgres; %s isn't", Lc.db.Identifier())
+	}
+	_, err := Lc.db.DB.Exec(LiveConfigTriggerSql)
+	return dbErrorOrNil(err)
 }
 
 func (Lc *LiveConfig) Update(Label string, Value interface{}) *LiveConfigKey {
@@ -1,13 +1,23 @@
 package shared
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 /*
 CREATE TABLE _LOOKUP_ (id serial not null primary key, name varchar(20) unique);
+
+Lookup tables are safe for concurrent use. Rows found by query, whether by name
+or by id, are cached like loaded ones. If another process inserts the same name
+between our select and our insert, the insert's duplicate-key error is answered
+by selecting the winner's row. Refresh() reloads the whole table; RefreshEvery
+does so on a timer.
 */
 
 type LookupItem interface {
@@ -35,6 +45,13 @@ type LookupTable interface {
 	LabelToId(string, bool) LookupItem
 	ByNameOrAdd(string) LookupItem
 	ByName(string) LookupItem
+	LabelToIdContext(context.Context, string, bool) LookupItem
+	ByNameOrAddContext(context.Context, string) LookupItem
+	Lookup(context.Context, string, bool) (LookupItem, error)
+	LookupId(context.Context, int) (LookupItem, error)
+	Refresh() error
+	RefreshEvery(context.Context, time.Duration)
+	Items() []LookupItem
 }
 
 type lookupTable struct {
@@ -49,6 +66,8 @@ type lookupTable struct {
 	selectIdStmt    *Stmt
 	loadStmt        *Stmt
 	compiled        bool
+	compileLock     sync.Mutex // Held across Compile's prepares
+	lock            sync.RWMutex
 	labelToId       map[string]*lookupMember
 	idToLabel       map[int]*lookupMember
 }
@@ -72,101 +91,213 @@ func (lm *lookupMember) IsNil() bool {
 	return !lm.notnil
 }
 
+func (l *lookupTable) cachedName(label string) *lookupMember {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.labelToId[label]
+}
+
+func (l *lookupTable) cachedId(id int) *lookupMember {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.idToLabel[id]
+}
+
+func (l *lookupTable) remember(id int, label string) *lookupMember {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if Existing := l.idToLabel[id]; Existing != nil && Existing.name == label {
+		return Existing
+	}
+	Rec := &lookupMember{
+		parent: l,
+		id:     id,
+		name:   label,
+		notnil: true,
+	}
+	l.labelToId[label] = Rec
+	l.idToLabel[id] = Rec
+	return Rec
+}
+
+// Items returns every cached row, by ascending id.
+func (l *lookupTable) Items() []LookupItem {
+	l.lock.RLock()
+	var Ids []int
+	for k := range l.idToLabel {
+		Ids = append(Ids, k)
+	}
+	sort.Ints(Ids)
+	Items := make([]LookupItem, 0, len(Ids))
+	for _, v := range Ids {
+		Items = append(Items, l.idToLabel[v])
+	}
+	l.lock.RUnlock()
+	return Items
+}
+
 func (l *lookupTable) ByNameOrAdd(label string) LookupItem {
-	if l.labelToId[label] == nil {
-		l.LabelToId(label, true)
+	return l.ByNameOrAddContext(nil, label)
+}
+
+// ByNameOrAddContext is LabelToIdContext with create set, except that, like
+// ByName, a failure gives a nil *lookupMember rather than a nil LookupItem.
+func (l *lookupTable) ByNameOrAddContext(ctx context.Context, label string) LookupItem {
+	if Rec := l.LabelToIdContext(ctx, label, true); Rec != nil {
+		return Rec
 	}
-	return l.labelToId[label]
+	return (*lookupMember)(nil)
 }
 
+// ByName returns the cached row named label; on a miss it's a nil
+// *lookupMember, whose IsNil() is true.
 func (l *lookupTable) ByName(label string) LookupItem {
-	return l.labelToId[label]
+	return l.cachedName(label)
 }
 
+// ByNameOrDie compiles the lookup if it hasn't been, then is ByName; despite
+// the name, a miss isn't fatal.
 func (l *lookupTable) ByNameOrDie(label string) LookupItem {
-	if l.compiled == false {
-		l.Compile()
-	}
-	return l.labelToId[label]
+	log.ErrorIff(l.CompileIfNeeded(), "compiling lookup '%s'", l.TableName)
+	return l.cachedName(label)
 }
 
 func (l *lookupTable) ByIdOrDie(id int) LookupItem {
-	if l.compiled == false {
-		l.Compile()
-	}
-	Lookup, found := l.idToLabel[id]
-	if !found {
-		log.Fatalf("Tried to resolve unknown market id '%d'\n", id)
+	Lookup, err := l.LookupId(nil, id)
+	log.FatalIff(err, "Tried to resolve id '%d' in '%s'\n", id, l.TableName)
+	if Lookup == nil {
+		log.Fatalf("Tried to resolve unknown id '%d' in '%s'\n", id, l.TableName)
 	}
 	return Lookup
 }
 
 func (l *lookupTable) ById(id int) LookupItem {
-	if l.compiled == false {
-		l.Compile()
-	}
-	Lookup, found := l.idToLabel[id]
-	if !found {
-		return nil
+	Lookup, err := l.LookupId(nil, id)
+	if err != nil {
+		log.Errorf("Lookup of id %d in '%s': %s\n", id, l.TableName, err)
 	}
 	return Lookup
 }
 
+// LookupId returns the row with this id, asking the database if it isn't
+// cached. The item is nil if there's no such row.
+func (l *lookupTable) LookupId(ctx context.Context, id int) (LookupItem, error) {
+	if Rec := l.cachedId(id); Rec != nil {
+		return Rec, nil
+	}
+	if err := l.CompileIfNeeded(); err != nil {
+		return nil, err
+	}
+	var label string
+	err := l.selectNameStmt.QueryRowContext(ctx, id).Scan(&label)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("selecting id %d from '%s': %w", id, l.TableName, dbErrorOrNil(err))
+	}
+	return l.remember(id, label), nil
+}
+
 func (l *lookupTable) LabelToId(label string, create bool) LookupItem {
-	var err error
-	var labelid = l.labelToId[label]
-	//fmt.Printf("Looking up label '%s'\n", label)
-	if labelid != nil {
-		return labelid
-	}
-	//log.Printf("Query '%s', label '%s'\n", l.SelectIdQuery, label)
-	selDb := l.selectIdStmt.QueryRow(label)
+	return l.LabelToIdContext(nil, label, create)
+}
+
+// LabelToIdContext is Lookup with the error logged; a miss is a nil LookupItem.
+func (l *lookupTable) LabelToIdContext(ctx context.Context, label string, create bool) LookupItem {
+	Rec, err := l.Lookup(ctx, label, create)
+	if err != nil {
+		log.Errorf("Lookup of '%s' in '%s': %s\n", label, l.TableName, err)
+	}
+	return Rec
+}
+
+func (l *lookupTable) selectLabel(ctx context.Context, label string) (LookupItem, error) {
 	var id int
-	err = selDb.Scan(&id)
+	err := l.selectIdStmt.QueryRowContext(ctx, label).Scan(&id)
 	if err == sql.ErrNoRows {
-		//fmt.Printf("No rows returned.\n")
-		if create == true {
-			Rec := l.insertLabel(label)
-			return Rec
-		}
-		return nil
+		return nil, nil
 	}
-	log.FatalIff(err, "LoadLookup LabelToId scan (%s): %s\n", label, err)
-	return nil
+	if err != nil {
+		return nil, fmt.Errorf("selecting '%s' from '%s': %w", label, l.TableName, dbErrorOrNil(err))
+	}
+	return l.remember(id, label), nil
 }
 
-func (l *lookupTable) Compile() {
-	if l.compiled == true {
-		fmt.Printf("Dangerous sketchy land: We're re-compiling a lookup!\n")
+// Lookup returns the row named label, asking the database if it isn't cached
+// and inserting it if create is set. The item is nil if there's no such row
+// and we weren't asked to create it.
+func (l *lookupTable) Lookup(ctx context.Context, label string, create bool) (LookupItem, error) {
+	if Rec := l.cachedName(label); Rec != nil {
+		return Rec, nil
 	}
+	if err := l.CompileIfNeeded(); err != nil {
+		return nil, err
+	}
+	Rec, err := l.selectLabel(ctx, label)
+	if err != nil || Rec != nil || !create {
+		return Rec, err
+	}
+	Rec, err = l.insertLabel(ctx, label)
+	if errors.Is(err, ErrDuplicateKey) {
+		log.Debugf("Lost the race to insert '%s' into '%s'; re-selecting.\n", label, l.TableName)
+		return l.selectLabel(ctx, label)
+	}
+	return Rec, err
+}
+
+// Compile prepares the lookup's statements. It holds compileLock rather than
+// lock while preparing, so cached lookups carry on during the round trips.
+func (l *lookupTable) Compile() error {
 	if l.db == nil {
-		fmt.Printf("Attempting to compile lookuptable %s with nil db handle!\n", l.TableName)
+		return fmt.Errorf("lookup table '%s' has a nil db handle", l.TableName)
 	}
-	l.loadStmt = l.db.Prepare(l.LoadQuery)
-	if l.loadStmt.Err() != nil {
-		log.Fatalf("Compile() for load query on table '%s' on handle '%s': %s\n", l.TableName, l.db.Identifier(), l.loadStmt.Err())
-		os.Exit(1)
+	l.compileLock.Lock()
+	defer l.compileLock.Unlock()
+	l.lock.RLock()
+	Compiled := l.compiled
+	l.lock.RUnlock()
+	if Compiled {
+		return nil
 	}
-	l.insertStmt = l.db.Prepare(l.InsertQuery)
-	if l.insertStmt.Err() != nil {
-		log.Fatalf("Compile() for insert on table %s on handle '%s': %s\n", l.TableName, l.db.Identifier(), l.insertStmt.Err())
-		os.Exit(1)
+	Queries := []struct {
+		Label string
+		Sql   string
+	}{
+		{"load query", l.LoadQuery},
+		{"insert", l.InsertQuery},
+		{"select id", l.SelectIdQuery},
+		{"select name", l.SelectNameQuery},
 	}
-	l.selectIdStmt = l.db.Prepare(l.SelectIdQuery)
-	if l.selectIdStmt.Err() != nil {
-		log.Fatalf("Compile() for select id on table %s on handle '%s': %s\n", l.TableName, l.db.Identifier(), l.selectIdStmt.Err())
-		os.Exit(1)
+	Stmts := make([]*Stmt, len(Queries))
+	for k, v := range Queries {
+		sth := l.db.Prepare(v.Sql)
+		if sth.Err() != nil {
+			return fmt.Errorf("Compile() for %s on table '%s' on handle '%s': %w",
+				v.Label, l.TableName, l.db.Identifier(), sth.Err())
+		}
+		// Lookups re-select what they've just inserted; a lagging replica
+		// wouldn't have it yet.
+		Stmts[k] = sth.FromPrimary()
 	}
+	l.lock.Lock()
+	l.loadStmt, l.insertStmt, l.selectIdStmt, l.selectNameStmt = Stmts[0], Stmts[1], Stmts[2], Stmts[3]
 	l.compiled = true
+	l.lock.Unlock()
+	return nil
 }
 
-func (l *lookupTable) CompileIfNeeded() {
-	if l.compiled == false {
-		l.Compile()
+func (l *lookupTable) CompileIfNeeded() error {
+	l.lock.RLock()
+	Compiled := l.compiled
+	l.lock.RUnlock()
+	if Compiled {
+		return nil
 	}
+	return l.Compile()
 }
 
-func NewLookup(tablename string, Db *DbHandle) LookupTable {
+func newLookupTable(tablename string, Db *DbHandle) *lookupTable {
 	var LT lookupTable
 	LT.db = Db
 	LT.TableName = tablename
@@ -181,60 +312,112 @@ func NewLookup(tablename string, Db *DbHandle) LookupTable {
 		LT.SelectIdQuery = fmt.Sprintf("SELECT id FROM %s WHERE name=$1;", tablename)
 		LT.InsertQuery = fmt.Sprintf("INSERT INTO %s (name) VALUES ($1) RETURNING id;", tablename)
 	}
-	LT.compiled = false
 	LT.labelToId = make(map[string]*lookupMember)
 	LT.idToLabel = make(map[int]*lookupMember)
-	LT.LoadLookup()
 	return &LT
 }
 
-func (l *lookupTable) insertLabel(label string) LookupItem {
-	Rec := lookupMember{
-		name:   label,
-		parent: l,
-		notnil: true,
+// OpenLookup loads the lookup table, failing if it can't.
+func OpenLookup(tablename string, Db *DbHandle) (LookupTable, error) {
+	LT := newLookupTable(tablename, Db)
+	if err := LT.Refresh(); err != nil {
+		return nil, err
 	}
+	return LT, nil
+}
+
+// NewLookup is OpenLookup for callers that can't handle an error; a table
+// that failed to load is still returned, and fills itself in by query.
+func NewLookup(tablename string, Db *DbHandle) LookupTable {
+	LT := newLookupTable(tablename, Db)
+	LT.LoadLookup()
+	return LT
+}
+
+func (l *lookupTable) insertLabel(ctx context.Context, label string) (LookupItem, error) {
+	var id int
 	if l.db.DbType() == DbTypePostgres {
-		Row := l.insertStmt.QueryRow(label)
-		var id int
-		err := Row.Scan(&id)
-		log.FatalIff(err, "Can't insert '%s' into '%s'\n", label, l.TableName)
-		Rec.id = id
+		err := l.insertStmt.QueryRowContext(ctx, label).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("can't insert '%s' into '%s': %w", label, l.TableName, dbErrorOrNil(err))
+		}
 	} else {
-		res, err := l.insertStmt.Exec(label)
-		log.FatalIff(err, "Failed on insertLabel for '%s'\n", l.TableName)
-		var id int64
-		id, err = res.LastInsertId()
-		log.FatalIff(err, "Failed to get id on insertLabel for '%s'\n", l.TableName)
-		Rec.id = int(id)
+		res, err := l.insertStmt.ExecContext(ctx, label)
+		if err != nil {
+			return nil, fmt.Errorf("can't insert '%s' into '%s': %w", label, l.TableName, err)
+		}
+		id64, err := res.LastInsertId()
+		if err != nil {
+			return nil, fmt.Errorf("can't get id of '%s' inserted into '%s': %w", label, l.TableName, err)
+		}
+		id = int(id64)
 	}
-	l.labelToId[label] = &Rec
-	l.idToLabel[Rec.id] = &Rec
-	return &Rec
+	return l.remember(id, label), nil
 }
 
 func (l *lookupTable) LoadLookup() *lookupTable {
-	var id int
-	var label string
-	l.CompileIfNeeded()
-	selDB, err := l.loadStmt.Query()
+	return l.LoadLookupContext(nil)
+}
+
+func (l *lookupTable) LoadLookupContext(ctx context.Context) *lookupTable {
+	if err := l.RefreshContext(ctx); err != nil {
+		log.Errorf("LoadLookup: %s\n", err)
+	}
+	return l
+}
+
+func (l *lookupTable) Refresh() error {
+	return l.RefreshContext(nil)
+}
+
+// RefreshContext reloads the whole table, then swaps it in, so readers never
+// see it half-loaded. Ids which disappeared from the table are forgotten.
+func (l *lookupTable) RefreshContext(ctx context.Context) error {
+	if err := l.CompileIfNeeded(); err != nil {
+		return err
+	}
+	selDB, err := l.loadStmt.QueryContext(ctx)
 	if err != nil {
-		fmt.Printf("ERROR on LoadLookup: %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("loading lookup '%s': %w", l.TableName, err)
 	}
+	defer selDB.Close()
+	Names := make(map[string]*lookupMember)
+	Ids := make(map[int]*lookupMember)
 	for selDB.Next() {
-		err = selDB.Scan(&id, &label)
-		if err != nil {
-			panic(err.Error())
+		Rec := &lookupMember{parent: l, notnil: true}
+		if err = selDB.Scan(&Rec.id, &Rec.name); err != nil {
+			return fmt.Errorf("loading lookup '%s': %w", l.TableName, err)
 		}
-		Rec := lookupMember{
-			parent: l,
-			id:     id,
-			name:   label,
-			notnil: true,
-		}
-		l.labelToId[label] = &Rec
-		l.idToLabel[id] = &Rec
+		Names[Rec.name] = Rec
+		Ids[Rec.id] = Rec
 	}
-	return l
+	if err = selDB.Err(); err != nil {
+		return fmt.Errorf("loading lookup '%s': %w", l.TableName, dbErrorOrNil(err))
+	}
+	l.lock.Lock()
+	l.labelToId = Names
+	l.idToLabel = Ids
+	l.lock.Unlock()
+	return nil
+}
+
+// RefreshEvery reloads the table every Interval until ctx is done. With a nil
+// ctx it keeps going, each reload running under the handle's base context.
+func (l *lookupTable) RefreshEvery(ctx context.Context, Interval time.Duration) {
+	Run := ctx
+	if Run == nil {
+		Run = context.Background()
+	}
+	go func() {
+		Ticker := time.NewTicker(Interval)
+		defer Ticker.Stop()
+		for {
+			select {
+			case <-Run.Done():
+				return
+			case <-Ticker.C:
+				log.ErrorIff(l.RefreshContext(ctx), "refreshing lookup '%s'", l.TableName)
+			}
+		}
+	}()
 }
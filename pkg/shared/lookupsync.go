@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Keeping lookup tables and code in agreement. SyncEnum makes sure a set of names
+exists, adding any that are missing in the order given. SyncEnumIds is what
+lookupgen's generated code calls: it pins each name to the id the code was
+generated with, inserting missing rows with that explicit id and failing if the
+table has since given a name or id to something else.
+*/
+
+// SyncEnum ensures every name is present in Table and returns the loaded lookup.
+func SyncEnum(Db *DbHandle, Table string, Names ...string) (LookupTable, error) {
+	LT, err := OpenLookup(Table, Db)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range Names {
+		Item, err := LT.Lookup(nil, v, true)
+		if err != nil {
+			return nil, fmt.Errorf("syncing '%s' into '%s': %w", v, Table, err)
+		}
+		if Item == nil {
+			return nil, fmt.Errorf("syncing '%s' into '%s': row vanished after insert", v, Table)
+		}
+	}
+	return LT, nil
+}
+
+// lookupMiss is true for either kind of miss: ById gives a nil LookupItem,
+// ByName a nil *lookupMember.
+func lookupMiss(Item LookupItem) bool {
+	return Item == nil || Item.IsNil()
+}
+
+// SyncEnumIds ensures Table holds exactly these id/name pairs, among whatever
+// other rows it has.
+func SyncEnumIds(Db *DbHandle, Table string, Want map[int]string) error {
+	LT, err := OpenLookup(Table, Db)
+	if err != nil {
+		return err
+	}
+	var Ids []int
+	for k := range Want {
+		Ids = append(Ids, k)
+	}
+	sort.Ints(Ids)
+	var Conflicts []string
+	var Missing []int
+	for _, Id := range Ids {
+		Name := Want[Id]
+		ById := LT.ById(Id)
+		ByName := LT.ByName(Name)
+		switch {
+		case !lookupMiss(ById) && ById.Name() != Name:
+			Conflicts = append(Conflicts, fmt.Sprintf("id %d is '%s', not '%s'", Id, ById.Name(), Name))
+		case !lookupMiss(ByName) && ByName.Id() != Id:
+			Conflicts = append(Conflicts, fmt.Sprintf("'%s' is id %d, not %d", Name, ByName.Id(), Id))
+		case lookupMiss(ById):
+			Missing = append(Missing, Id)
+		}
+	}
+	if len(Conflicts) > 0 {
+		return fmt.Errorf("lookup table '%s' disagrees with the code: %s", Table, strings.Join(Conflicts, "; "))
+	}
+	if len(Missing) == 0 {
+		return nil
+	}
+	Insert := Db.Prepare(fmt.Sprintf("INSERT INTO %s (id,name) VALUES (%s,%s)",
+		Db.QuoteIdent(Table), placeholderFor(Db.dbtype, 1), placeholderFor(Db.dbtype, 2)))
+	if err = Insert.Err(); err != nil {
+		return fmt.Errorf("syncing lookup table '%s': %w", Table, err)
+	}
+	for _, Id := range Missing {
+		if _, err = Insert.Exec(Id, Want[Id]); err != nil {
+			return fmt.Errorf("adding %d='%s' to '%s': %w", Id, Want[Id], Table, err)
+		}
+		log.Infof("Added %d='%s' to lookup table '%s'\n", Id, Want[Id], Table)
+	}
+	if Db.dbtype == DbTypePostgres {
+		// Explicit ids don't advance a serial; catch it up so later inserts don't collide.
+		// pg_get_serial_sequence parses its table name as SQL would, so it wants the quoted form.
+		_, err = Db.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence($1, 'id'), (SELECT MAX(id) FROM %s))",
+			Db.QuoteIdent(Table)), Db.QuoteIdent(Table))
+		if err != nil {
+			return fmt.Errorf("advancing id sequence of '%s': %w", Table, dbErrorOrNil(err))
+		}
+	}
+	return LT.Refresh()
+}
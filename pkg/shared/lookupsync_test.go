@@ -0,0 +1,28 @@
+package shared
+
+import (
+	"testing"
+)
+
+func TestSyncEnumIds(t *testing.T) {
+	Fake := NewFakeDb(t.Name(), DbTypePostgres)
+	Fake.On(`^SELECT id,name FROM colors`).Return([]string{"id", "name"},
+		[]interface{}{int64(1), "red"})
+	dbh := Fake.Handle()
+	defer dbh.Close()
+
+	if err := SyncEnumIds(dbh, "colors", map[int]string{1: "red", 2: "green"}); err != nil {
+		t.Fatalf("SyncEnumIds: %s", err)
+	}
+	Inserts := Fake.CallsMatching(`^INSERT INTO "colors" \(id,name\)`)
+	if len(Inserts) != 1 || Inserts[0].Args[0] != int64(2) || Inserts[0].Args[1] != "green" {
+		t.Errorf("inserts were %+v; want just 2='green'", Inserts)
+	}
+	if len(Fake.CallsMatching(`^SELECT setval`)) != 1 {
+		t.Errorf("the id sequence wasn't advanced")
+	}
+
+	if err := SyncEnumIds(dbh, "colors", map[int]string{1: "blue"}); err == nil {
+		t.Errorf("a name conflicting with the table went unreported")
+	}
+}
@@ -0,0 +1,455 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/grammaton76/g76golib/pkg/sjson"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+Typed lookup tables. Where NewLookup only knows (id, name), a TypedLookup[T]
+loads whole rows into T, mapping columns to fields the way ScanStructs does:
+
+	type Market struct {
+		Id       int           `db:"id"`
+		Name     string        `db:"name"`
+		Exchange string        `db:"exchange"`
+		Enabled  bool          `db:"enabled"`
+		ParentId sql.NullInt64 `db:"parent_id"`
+		Attrs    sjson.JSON    `db:"attrs"`
+	}
+	Markets, err := shared.NewTypedLookup[Market](dbh, "markets",
+		&shared.TypedLookupOptions{KeyColumns: []string{"exchange", "name"}, ParentColumn: "parent_id"})
+
+The natural key defaults to "name"; a composite one is passed to ByKey in
+KeyColumns order. With a ParentColumn, rows form a tree for Parent, Children
+and Ancestors. Misses are queried and cached, and ByKeyOrAdd survives racing
+another process to the insert, the same as LookupTable.
+*/
+
+type TypedLookupOptions struct {
+	IdColumn     string   // Default "id"
+	KeyColumns   []string // Natural key; default "name"
+	ParentColumn string   // Column holding the parent row's id, if the table is a tree
+}
+
+type TypedLookup[T any] struct {
+	db       *DbHandle
+	Table    string
+	opts     TypedLookupOptions
+	columns  []string
+	fields   structFieldMap
+	lock     sync.RWMutex
+	byId     map[int]*T
+	byKey    map[string]*T
+	children map[int][]*T
+
+	loadStmt      *Stmt
+	selectIdStmt  *Stmt
+	selectKeyStmt *Stmt
+}
+
+func NewTypedLookup[T any](Db *DbHandle, Table string, Opts *TypedLookupOptions) (*TypedLookup[T], error) {
+	var Zero T
+	Type := reflect.TypeOf(Zero)
+	if Type == nil || Type.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("typed lookup on '%s' needs a struct type, not %T", Table, Zero)
+	}
+	tl := &TypedLookup[T]{db: Db, Table: Table, fields: structFieldsOf(Type), columns: StructColumns(Zero)}
+	if Opts != nil {
+		tl.opts = *Opts
+	}
+	if tl.opts.IdColumn == "" {
+		tl.opts.IdColumn = "id"
+	}
+	if len(tl.opts.KeyColumns) == 0 {
+		tl.opts.KeyColumns = []string{"name"}
+	}
+	Needed := append([]string{tl.opts.IdColumn}, tl.opts.KeyColumns...)
+	if tl.opts.ParentColumn != "" {
+		Needed = append(Needed, tl.opts.ParentColumn)
+	}
+	for _, v := range Needed {
+		if _, found := tl.fields[strings.ToLower(v)]; !found {
+			return nil, fmt.Errorf("%s has no field for column '%s' of '%s'", Type, v, Table)
+		}
+	}
+	var Quoted, Where []string
+	for _, v := range tl.columns {
+		Quoted = append(Quoted, Db.QuoteIdent(v))
+	}
+	for k, v := range tl.opts.KeyColumns {
+		Where = append(Where, fmt.Sprintf("%s=%s", Db.QuoteIdent(v), placeholderFor(Db.dbtype, k+1)))
+	}
+	Select := fmt.Sprintf("SELECT %s FROM %s", strings.Join(Quoted, ","), Db.QuoteIdent(Table))
+	for _, v := range []struct {
+		Sql  string
+		Dest **Stmt
+	}{
+		{Select, &tl.loadStmt},
+		{fmt.Sprintf("%s WHERE %s=%s", Select, Db.QuoteIdent(tl.opts.IdColumn), placeholderFor(Db.dbtype, 1)), &tl.selectIdStmt},
+		{fmt.Sprintf("%s WHERE %s", Select, strings.Join(Where, " AND ")), &tl.selectKeyStmt},
+	} {
+		sth := Db.Prepare(v.Sql)
+		if err := sth.Err(); err != nil {
+			return nil, fmt.Errorf("typed lookup on '%s': %w", Table, dbErrorOrNil(err))
+		}
+		// On the primary, so that ByKeyOrAdd's re-select sees its own insert.
+		*v.Dest = sth.FromPrimary()
+	}
+	return tl, tl.Refresh()
+}
+
+func (tl *TypedLookup[T]) field(Row *T, Column string) reflect.Value {
+	return fieldByIndexAlloc(reflect.ValueOf(Row).Elem(), tl.fields[strings.ToLower(Column)])
+}
+
+// columnInt reads an integer column's field, whatever its Go type; ok is false
+// for NULL.
+func columnInt(Field reflect.Value) (int, bool) {
+	if Valuer, isValuer := Field.Interface().(driver.Valuer); isValuer {
+		Val, err := Valuer.Value()
+		if err != nil || Val == nil {
+			return 0, false
+		}
+		Field = reflect.ValueOf(Val)
+	}
+	for Field.Kind() == reflect.Ptr {
+		if Field.IsNil() {
+			return 0, false
+		}
+		Field = Field.Elem()
+	}
+	switch Field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(Field.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(Field.Uint()), true
+	}
+	return 0, false
+}
+
+func (tl *TypedLookup[T]) IdOf(Row *T) int {
+	Id, _ := columnInt(tl.field(Row, tl.opts.IdColumn))
+	return Id
+}
+
+func (tl *TypedLookup[T]) parentOf(Row *T) (int, bool) {
+	if tl.opts.ParentColumn == "" {
+		return 0, false
+	}
+	return columnInt(tl.field(Row, tl.opts.ParentColumn))
+}
+
+// lookupKey renders key values the same whether they come from a row's fields
+// or ByKey's arguments: Valuers (sql.NullString and co) give their value,
+// pointers are followed, and NULL is kept apart from any string.
+func lookupKey(Values []interface{}) string {
+	var Parts []string
+	for _, v := range Values {
+		v = lookupKeyValue(v)
+		switch Val := v.(type) {
+		case nil:
+			Parts = append(Parts, "\x01")
+		case []byte:
+			Parts = append(Parts, string(Val))
+		default:
+			Parts = append(Parts, fmt.Sprintf("%v", Val))
+		}
+	}
+	return strings.Join(Parts, "\x00")
+}
+
+func lookupKeyValue(v interface{}) interface{} {
+	for v != nil {
+		Ptr := reflect.ValueOf(v)
+		if Ptr.Kind() == reflect.Ptr && Ptr.IsNil() {
+			return nil
+		}
+		if Valuer, isValuer := v.(driver.Valuer); isValuer {
+			Val, err := Valuer.Value()
+			if err != nil {
+				return v
+			}
+			v = Val
+			continue
+		}
+		if Ptr.Kind() != reflect.Ptr {
+			return v
+		}
+		v = Ptr.Elem().Interface()
+	}
+	return nil
+}
+
+func (tl *TypedLookup[T]) keyValues(Row *T) []interface{} {
+	var Values []interface{}
+	for _, v := range tl.opts.KeyColumns {
+		Values = append(Values, tl.field(Row, v).Interface())
+	}
+	return Values
+}
+
+// index adds Row to the maps; the caller holds the write lock.
+func (tl *TypedLookup[T]) index(Row *T) {
+	Id := tl.IdOf(Row)
+	if Old := tl.byId[Id]; Old != nil {
+		if OldKey := lookupKey(tl.keyValues(Old)); tl.byKey[OldKey] == Old {
+			delete(tl.byKey, OldKey)
+		}
+		if Parent, ok := tl.parentOf(Old); ok {
+			Siblings := tl.children[Parent]
+			for k, v := range Siblings {
+				if v == Old {
+					tl.children[Parent] = append(Siblings[:k:k], Siblings[k+1:]...)
+					break
+				}
+			}
+		}
+	}
+	tl.byId[Id] = Row
+	tl.byKey[lookupKey(tl.keyValues(Row))] = Row
+	if Parent, ok := tl.parentOf(Row); ok {
+		tl.children[Parent] = append(tl.children[Parent], Row)
+	}
+}
+
+func (tl *TypedLookup[T]) remember(Row *T) *T {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	tl.index(Row)
+	return Row
+}
+
+func (tl *TypedLookup[T]) queryOne(ctx context.Context, sth *Stmt, args ...interface{}) (*T, error) {
+	Rows, err := sth.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("typed lookup on '%s': %w", tl.Table, err)
+	}
+	defer Rows.Close()
+	var Row T
+	Unmapped, err := ScanStruct(Rows, &Row)
+	sth.warnUnmapped(Unmapped)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("typed lookup on '%s': %w", tl.Table, err)
+	}
+	return tl.remember(&Row), nil
+}
+
+// Refresh reloads the whole table and swaps it in.
+func (tl *TypedLookup[T]) Refresh() error {
+	return tl.RefreshContext(nil)
+}
+
+func (tl *TypedLookup[T]) RefreshContext(ctx context.Context) error {
+	Rows, err := tl.loadStmt.QueryContext(ctx)
+	if err != nil {
+		return fmt.Errorf("loading typed lookup '%s': %w", tl.Table, err)
+	}
+	defer Rows.Close()
+	var Loaded []*T
+	Unmapped, err := ScanStructs(Rows, &Loaded)
+	tl.loadStmt.warnUnmapped(Unmapped)
+	if err != nil {
+		return fmt.Errorf("loading typed lookup '%s': %w", tl.Table, err)
+	}
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	tl.byId = make(map[int]*T)
+	tl.byKey = make(map[string]*T)
+	tl.children = make(map[int][]*T)
+	for _, v := range Loaded {
+		tl.index(v)
+	}
+	return nil
+}
+
+func (tl *TypedLookup[T]) All() []*T {
+	tl.lock.RLock()
+	defer tl.lock.RUnlock()
+	var Rows []*T
+	for _, v := range tl.byId {
+		Rows = append(Rows, v)
+	}
+	return Rows
+}
+
+// LookupId returns the row with this id, querying on a cache miss; nil if
+// there's no such row.
+func (tl *TypedLookup[T]) LookupId(ctx context.Context, Id int) (*T, error) {
+	tl.lock.RLock()
+	Row := tl.byId[Id]
+	tl.lock.RUnlock()
+	if Row != nil {
+		return Row, nil
+	}
+	return tl.queryOne(ctx, tl.selectIdStmt, Id)
+}
+
+func (tl *TypedLookup[T]) ById(Id int) *T {
+	Row, err := tl.LookupId(nil, Id)
+	if err != nil {
+		log.Errorf("Lookup of id %d in '%s': %s\n", Id, tl.Table, err)
+	}
+	return Row
+}
+
+func (tl *TypedLookup[T]) ByIdOrDie(Id int) *T {
+	Row, err := tl.LookupId(nil, Id)
+	log.FatalIff(err, "Tried to resolve id '%d' in '%s'\n", Id, tl.Table)
+	if Row == nil {
+		log.Fatalf("Tried to resolve unknown id '%d' in '%s'\n", Id, tl.Table)
+	}
+	return Row
+}
+
+// ByKey returns the row whose KeyColumns hold Keys, querying on a cache miss;
+// nil if there's no such row.
+func (tl *TypedLookup[T]) ByKey(ctx context.Context, Keys ...interface{}) (*T, error) {
+	if len(Keys) != len(tl.opts.KeyColumns) {
+		return nil, fmt.Errorf("lookup '%s' has key %v; got %d values", tl.Table, tl.opts.KeyColumns, len(Keys))
+	}
+	tl.lock.RLock()
+	Row := tl.byKey[lookupKey(Keys)]
+	tl.lock.RUnlock()
+	if Row != nil {
+		return Row, nil
+	}
+	return tl.queryOne(ctx, tl.selectKeyStmt, Keys...)
+}
+
+// ByName is the cache-only lookup of a single-column key, like LookupTable's.
+func (tl *TypedLookup[T]) ByName(Name string) *T {
+	tl.lock.RLock()
+	defer tl.lock.RUnlock()
+	return tl.byKey[lookupKey([]interface{}{Name})]
+}
+
+func (tl *TypedLookup[T]) insert(ctx context.Context, Row *T) error {
+	Caw := sjson.NewJson()
+	Value := reflect.ValueOf(Row).Elem()
+	for _, Col := range tl.columns {
+		if Col == strings.ToLower(tl.opts.IdColumn) {
+			continue
+		}
+		Field := fieldByIndexAlloc(Value, tl.fields[Col])
+		if Field.Kind() == reflect.Ptr && Field.IsNil() {
+			continue // Let the column default apply.
+		}
+		Caw[Col] = Field.Interface()
+	}
+	ib := &insertBuilder{Db: tl.db.DB, Type: tl.db.dbtype, Table: tl.Table}
+	Cols := make([]string, 0, len(Caw))
+	for _, Col := range tl.columns {
+		if _, found := Caw[Col]; found {
+			Cols = append(Cols, Col)
+		}
+	}
+	Query, Args := ib.statement(Cols, []sjson.JSON{Caw})
+	ctx, cancel := tl.db.statementContext(ctx)
+	defer cancel()
+	_, err := tl.db.DB.ExecContext(ctx, Query, Args...)
+	return dbErrorOrNil(err)
+}
+
+// ByKeyOrAdd returns the row with Row's key, inserting Row (less its id) if
+// there isn't one yet. The returned row is as the database has it.
+func (tl *TypedLookup[T]) ByKeyOrAdd(ctx context.Context, Row *T) (*T, error) {
+	Keys := tl.keyValues(Row)
+	Found, err := tl.ByKey(ctx, Keys...)
+	if err != nil || Found != nil {
+		return Found, err
+	}
+	err = tl.insert(ctx, Row)
+	if err != nil && !errors.Is(err, ErrDuplicateKey) {
+		return nil, fmt.Errorf("can't insert into '%s': %w", tl.Table, err)
+	}
+	if err != nil {
+		log.Debugf("Lost the race to insert %v into '%s'; re-selecting.\n", Keys, tl.Table)
+	}
+	// Re-select rather than trust LastInsertId, so defaults and triggers show.
+	return tl.queryOne(ctx, tl.selectKeyStmt, Keys...)
+}
+
+// ByNameOrAdd is ByKeyOrAdd for a table keyed on a single string column.
+func (tl *TypedLookup[T]) ByNameOrAdd(Name string) *T {
+	var Row T
+	Field := tl.field(&Row, tl.opts.KeyColumns[0])
+	if len(tl.opts.KeyColumns) != 1 || Field.Kind() != reflect.String {
+		log.Errorf("ByNameOrAdd on '%s' needs a single string key, not %v\n", tl.Table, tl.opts.KeyColumns)
+		return nil
+	}
+	Field.SetString(Name)
+	Found, err := tl.ByKeyOrAdd(nil, &Row)
+	if err != nil {
+		log.Errorf("Lookup of '%s' in '%s': %s\n", Name, tl.Table, err)
+	}
+	return Found
+}
+
+func (tl *TypedLookup[T]) Parent(Row *T) *T {
+	Parent, ok := tl.parentOf(Row)
+	if !ok {
+		return nil
+	}
+	return tl.ById(Parent)
+}
+
+func (tl *TypedLookup[T]) Children(Row *T) []*T {
+	tl.lock.RLock()
+	defer tl.lock.RUnlock()
+	return append([]*T{}, tl.children[tl.IdOf(Row)]...)
+}
+
+// Ancestors walks up from Row's parent to the root, stopping on a cycle.
+func (tl *TypedLookup[T]) Ancestors(Row *T) []*T {
+	var Chain []*T
+	Seen := map[int]bool{tl.IdOf(Row): true}
+	for Next := tl.Parent(Row); Next != nil; Next = tl.Parent(Next) {
+		if Seen[tl.IdOf(Next)] {
+			log.Warnf("Parent cycle in '%s' at id %d\n", tl.Table, tl.IdOf(Next))
+			break
+		}
+		Seen[tl.IdOf(Next)] = true
+		Chain = append(Chain, Next)
+	}
+	return Chain
+}
+
+// Descendants returns every row below Row, breadth first.
+func (tl *TypedLookup[T]) Descendants(Row *T) []*T {
+	var Found []*T
+	Seen := map[int]bool{tl.IdOf(Row): true}
+	Queue := tl.Children(Row)
+	for len(Queue) > 0 {
+		Next := Queue[0]
+		Queue = Queue[1:]
+		if Seen[tl.IdOf(Next)] {
+			continue
+		}
+		Seen[tl.IdOf(Next)] = true
+		Found = append(Found, Next)
+		Queue = append(Queue, tl.Children(Next)...)
+	}
+	return Found
+}
+
+// Roots returns the rows with no parent.
+func (tl *TypedLookup[T]) Roots() []*T {
+	var Roots []*T
+	for _, v := range tl.All() {
+		if _, ok := tl.parentOf(v); !ok {
+			Roots = append(Roots, v)
+		}
+	}
+	return Roots
+}
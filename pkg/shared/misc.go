@@ -212,9 +212,7 @@ func (c *SafeIntCache) Inc(keys ...string) (val int) {
 }
 
 func NewSafeIntCache() SafeIntCache {
-	var Bob SafeIntCache
-	Bob.vars = make(map[string]int)
-	return Bob
+	return SafeIntCache{vars: make(map[string]int)}
 }
 
 type ThreadPurpose struct {
@@ -395,5 +393,4 @@ func ReadStdinToEofBytes() []byte {
 			return buf
 		}
 	}
-	return nil
 }
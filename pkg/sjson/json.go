@@ -156,7 +156,34 @@ func (j *JSON) ScanRow(Result *sql.Rows) error {
 	return fmt.Errorf("result set had %d rows; ScanRow function only works with one.", Length)
 }
 
+// TimeCodec decodes date and time columns for ScanRowsWith. DbType is the
+// column's database type name, and Src whatever the driver produced
+// (time.Time, []byte, string or nil); the result goes into the row as is, so
+// should be a time.Time or nil.
+type TimeCodec interface {
+	ScanTime(DbType string, Src interface{}) (interface{}, error)
+}
+
+func isTimeColumn(DbType string) bool {
+	switch DbType {
+	case "DATE", "DATETIME", "TIMESTAMP", "TIMESTAMPTZ":
+		return true
+	}
+	return false
+}
+
+// DefaultTimeCodec is what ScanRows decodes date and time columns with; nil
+// (the default) leaves them to the driver. A program whose databases share a
+// zone can set it once rather than calling ScanRowsWith everywhere.
+var DefaultTimeCodec TimeCodec
+
 func (j *JSONarray) ScanRows(Result *sql.Rows) error {
+	return j.ScanRowsWith(Result, DefaultTimeCodec)
+}
+
+// ScanRowsWith is ScanRows with date and time columns decoded by Codec; a nil
+// Codec leaves them as the driver's scan type dictates.
+func (j *JSONarray) ScanRowsWith(Result *sql.Rows, Codec TimeCodec) error {
 	var ScanArray []interface{}
 	var Buf JSON
 	Buf.New()
@@ -164,10 +191,18 @@ func (j *JSONarray) ScanRows(Result *sql.Rows) error {
 	if err != nil {
 		log.Fatalf("Fatal error pulling result metadata: %s!\n", err)
 	}
+	TimeCols := make(map[int]bool)
 	//log.Printf("Found types: %+v\n", Types)
 	for i, v := range Types {
 		var Target interface{}
 		Name := v.Name()
+		if Codec != nil && isTimeColumn(v.DatabaseTypeName()) {
+			var Caw interface{}
+			Buf[Name] = &Caw
+			TimeCols[i] = true
+			ScanArray = append(ScanArray, Buf[Name])
+			continue
+		}
 		log.Debugf("Column %d ('%s') is a '%+v'\n", i+1, Name, v.ScanType())
 		switch v.ScanType().String() {
 		case "uint32":
@@ -221,6 +256,14 @@ func (j *JSONarray) ScanRows(Result *sql.Rows) error {
 		S.New()
 		for k, v := range ScanArray {
 			//log.Printf("Column %d\n", k)
+			if TimeCols[k] {
+				Caw, err := Codec.ScanTime(Types[k].DatabaseTypeName(), *(v.(*interface{})))
+				if err != nil {
+					return fmt.Errorf("column '%s': %w", Types[k].Name(), err)
+				}
+				S[Types[k].Name()] = Caw
+				continue
+			}
 			if v != nil {
 				Name := Types[k].Name()
 				Type := Types[k].ScanType().String()
@@ -557,6 +600,21 @@ func (j *JSON) IngestFromString(Input string) error {
 	return j.IngestFromBytes([]byte(Input))
 }
 
+// Scan implements sql.Scanner, so a JSON or text column holding an object can
+// be scanned straight into a JSON; NULL leaves it nil.
+func (j *JSON) Scan(Src interface{}) error {
+	switch Val := Src.(type) {
+	case nil:
+		*j = nil
+		return nil
+	case []byte:
+		return j.IngestFromBytes(Val)
+	case string:
+		return j.IngestFromString(Val)
+	}
+	return fmt.Errorf("can't scan %T into a JSON object", Src)
+}
+
 func NewJsonFromObject(Input interface{}) *JSON {
 	Binary, err := json.Marshal(Input)
 	log.ErrorIff(err, "Marshal error in newjsonfromobject")